@@ -0,0 +1,417 @@
+package awair
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"net/http"
+	"reflect"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"golang.org/x/time/rate"
+)
+
+// settings is the response from a device's /settings/config/data endpoint.
+type settings struct {
+	// DeviceUUID is the model and device id, e.g. "awair-element_1234"
+	DeviceUUID string `json:"device_uuid"`
+	FwVersion  string `json:"fw_version"`
+
+	// Display is what the screen shows, e.g. "score", if reported
+	Display string `json:"display"`
+
+	// LED is the light settings, if reported
+	LED *struct {
+		Mode       string `json:"mode"`
+		Brightness *int   `json:"brightness"`
+	} `json:"led"`
+}
+
+// model returns the device model from its uuid, or "" if there isn't one.
+func (s settings) model() string {
+	model, _, _ := strings.Cut(s.DeviceUUID, "_")
+	return model
+}
+
+// AirData is the response from a device's /air-data endpoints.
+type AirData struct {
+	// Timestamp is RFC3339 w/ millis, "2006-01-02T15:04:05.000Z"
+	Timestamp      string  `json:"timestamp"`
+	Score          float64 `json:"score"`
+	DewPoint       float64 `json:"dew_point"`
+	Temp           float64 `json:"temp"`
+	Humid          float64 `json:"humid"`
+	AbsHumid       float64 `json:"abs_humid"`
+	Co2            int64   `json:"co2"`
+	Co2Est         int64   `json:"co2_est"`
+	Co2EstBaseline int64   `json:"co2_est_baseline"`
+	Voc            int64   `json:"voc"`
+	VocBaseline    int64   `json:"voc_baseline"`
+	VocH2Raw       int64   `json:"voc_h2_raw"`
+	VocEthanolRaw  int64   `json:"voc_ethanol_raw"`
+	Pm25           int64   `json:"pm25"`
+	Pm10Est        int64   `json:"pm10_est"`
+
+	// Lux and SplA are only reported by the Omni, so their presence
+	// identifies it
+	Lux  *float64 `json:"lux"`
+	SplA *float64 `json:"spl_a"`
+
+	// invalid holds the JSON names of fields that failed to decode in
+	// best-effort mode
+	invalid map[string]bool
+
+	// present holds the JSON names of the sensor fields, every field but
+	// Timestamp, that had a non-null value in the response
+	present map[string]bool
+}
+
+// UnmarshalJSON decodes d from a device response. Some firmware reports
+// readings on the raw endpoint as objects like {"value": 45.3, ...}; those
+// are decoded as their value.
+func (d *AirData) UnmarshalJSON(buf []byte) error {
+	var raw map[string]json.RawMessage
+	if err := json.Unmarshal(buf, &raw); err != nil {
+		return err
+	}
+
+	unwrapped := false
+	for name, msg := range raw {
+		if value, ok := unwrapObject(msg); ok {
+			raw[name] = value
+			unwrapped = true
+		}
+	}
+	if unwrapped {
+		var err error
+		if buf, err = json.Marshal(raw); err != nil {
+			return err
+		}
+	}
+
+	// plain has AirData's fields without this method.
+	type plain AirData
+	if err := json.Unmarshal(buf, (*plain)(d)); err != nil {
+		return err
+	}
+
+	d.markPresent(raw)
+	return nil
+}
+
+// markPresent sets d.present from the non-null sensor fields in raw.
+func (d *AirData) markPresent(raw map[string]json.RawMessage) {
+	d.present = make(map[string]bool)
+	for name := range airDataFields {
+		if msg, ok := raw[name]; ok && string(bytes.TrimSpace(msg)) != "null" {
+			d.present[name] = true
+		}
+	}
+}
+
+// unwrapObject returns the "value" field of msg if it's an object that has
+// one.
+func unwrapObject(msg json.RawMessage) (json.RawMessage, bool) {
+	if !bytes.HasPrefix(bytes.TrimSpace(msg), []byte("{")) {
+		return nil, false
+	}
+
+	var obj struct {
+		Value json.RawMessage `json:"value"`
+	}
+	if err := json.Unmarshal(msg, &obj); err != nil || obj.Value == nil {
+		return nil, false
+	}
+	return obj.Value, true
+}
+
+// decodeFields decodes each of raw's fields into the matching field of d,
+// recording those that fail in d.invalid.
+func (d *AirData) decodeFields(raw map[string]json.RawMessage) {
+	v := reflect.ValueOf(d).Elem()
+	t := v.Type()
+
+	for i := 0; i < t.NumField(); i++ {
+		name, _, _ := strings.Cut(t.Field(i).Tag.Get("json"), ",")
+		msg, ok := raw[name]
+		if name == "" || !ok {
+			continue
+		}
+
+		if value, ok := unwrapObject(msg); ok {
+			msg = value
+		}
+
+		if err := json.Unmarshal(msg, v.Field(i).Addr().Interface()); err != nil {
+			if d.invalid == nil {
+				d.invalid = make(map[string]bool)
+			}
+			d.invalid[name] = true
+		}
+	}
+
+	d.markPresent(raw)
+}
+
+// model infers the device model from the fields present in the readings.
+func (d AirData) model() string {
+	if d.Lux != nil || d.SplA != nil {
+		return "awair-omni"
+	}
+	return "unknown"
+}
+
+// logAttrs returns the timestamp and each reading that was present and
+// decoded, by JSON name, as slog attributes. Readings the device didn't
+// report are left out rather than logged as zero.
+func (d AirData) logAttrs() []any {
+	names := make([]string, 0, len(d.present))
+	for name := range d.present {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	attrs := []any{slog.String("timestamp", d.Timestamp)}
+	for _, name := range names {
+		if v, ok := d.field(name); ok {
+			attrs = append(attrs, slog.Float64(name, v))
+		}
+	}
+	return attrs
+}
+
+// fetchError is returned by fetch with a reason for the errors metric.
+type fetchError struct {
+	reason string
+	err    error
+
+	// status is the HTTP status code of a non-200 response
+	status int
+}
+
+func (e fetchError) Error() string {
+	return e.err.Error()
+}
+
+// Reasons for fetch failures. Failed requests are logged but not counted
+// as collection errors.
+const (
+	reasonRequest   = "request"
+	reasonStatus    = "status"
+	reasonParse     = "parse"
+	reasonEmptyBody = "empty_body"
+	reasonRateLimit = "rate_limited"
+	reasonRedirect  = "redirect"
+)
+
+// Fetch requests air data for the endpoint window, e.g. "latest", from the
+// device at addr.
+func Fetch(ctx context.Context, client *http.Client, addr, endpoint string) (AirData, error) {
+	var data AirData
+	err := getJSON(ctx, client, nil, "http://"+addr, airDataPath(endpoint), &data, nil)
+	return data, err
+}
+
+// fetch requests air data for the endpoint window from the device at addr.
+func (c *Collector) fetch(ctx context.Context, name, addr, endpoint string) (AirData, error) {
+	var data AirData
+
+	if !c.BestEffortDecode {
+		err := c.get(ctx, name, addr, c.path(endpoint), &data)
+		return data, err
+	}
+
+	var raw map[string]json.RawMessage
+	if err := c.get(ctx, name, addr, c.path(endpoint), &raw); err != nil {
+		return data, err
+	}
+
+	data.decodeFields(raw)
+	for field := range data.invalid {
+		slog.Warn("Could not decode field", "sensor", name, "addr", addr, "field", field, "value", string(raw[field]))
+		c.fieldErrors.WithLabelValues(name, field).Inc()
+	}
+
+	return data, nil
+}
+
+// airDataPath returns the URL path of an /air-data endpoint window.
+func airDataPath(endpoint string) string {
+	return "/air-data/" + endpoint
+}
+
+// path returns the URL path c scrapes for endpoint.
+func (c *Collector) path(endpoint string) string {
+	if path, ok := c.Paths[endpoint]; ok {
+		return path
+	}
+	return airDataPath(endpoint)
+}
+
+// fetchSettings requests the device's settings from addr.
+func (c *Collector) fetchSettings(ctx context.Context, name, addr string) (settings, error) {
+	var data settings
+	err := c.get(ctx, name, addr, "/settings/config/data", &data)
+	return data, err
+}
+
+// get requests path from the device at addr and decodes the JSON response
+// into v, retrying failed requests and retryable statuses up to c.Retries
+// times.
+func (c *Collector) get(ctx context.Context, name, addr, path string, v any) error {
+	for attempt := 1; ; attempt++ {
+		err := c.getOnce(ctx, name, addr, path, v)
+		if err == nil || attempt > c.Retries || !c.retryable(err.(fetchError)) {
+			return err
+		}
+
+		slog.Debug("Retrying", "sensor", name, "addr", addr, "path", path, "attempt", attempt, "err", err)
+		select {
+		case <-time.After(time.Duration(attempt) * 100 * time.Millisecond):
+		case <-ctx.Done():
+			return err
+		}
+	}
+}
+
+// waitLimit waits until the device's rate limit allows another request. It
+// fails rather than wait past the request's deadline.
+func (c *Collector) waitLimit(ctx context.Context, addr string) error {
+	if c.RateLimit == 0 {
+		return nil
+	}
+
+	c.mu.Lock()
+	limiter, ok := c.limiters[addr]
+	if !ok {
+		limiter = rate.NewLimiter(c.RateLimit, c.RateBurst)
+		c.limiters[addr] = limiter
+	}
+	c.mu.Unlock()
+
+	r := limiter.Reserve()
+	delay := r.Delay()
+	if deadline, ok := ctx.Deadline(); ok && delay > time.Until(deadline) {
+		r.Cancel()
+		return fmt.Errorf("rate limited for %s", delay)
+	}
+
+	select {
+	case <-time.After(delay):
+		return nil
+	case <-ctx.Done():
+		r.Cancel()
+		return ctx.Err()
+	}
+}
+
+// retryable reports whether a request that failed with err may be retried.
+func (c *Collector) retryable(err fetchError) bool {
+	switch err.reason {
+	case reasonRequest:
+		return true
+	case reasonStatus:
+		return c.RetryStatus[err.status]
+	default:
+		return false
+	}
+}
+
+// requestTimeout returns the time allowed for a device request started
+// now: the client timeout, or what remains of ctx's deadline if that's
+// sooner, so requests late in a slow collection don't overrun it. It
+// returns false if neither applies.
+func (c *Collector) requestTimeout(ctx context.Context) (time.Duration, bool) {
+	timeout := c.Client.Timeout
+	if deadline, ok := ctx.Deadline(); ok {
+		if remaining := time.Until(deadline); timeout == 0 || remaining < timeout {
+			timeout = remaining
+		}
+	} else if timeout == 0 {
+		return 0, false
+	}
+	return timeout, true
+}
+
+// getOnce requests path from the device at addr and decodes the JSON
+// response into v.
+func (c *Collector) getOnce(ctx context.Context, name, addr, path string, v any) error {
+	timeout, ok := c.requestTimeout(ctx)
+	if ok && timeout <= 0 {
+		return fetchError{reason: reasonRequest, err: errors.New("request failed: collect deadline exceeded")}
+	}
+	if ok {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, timeout)
+		defer cancel()
+	}
+
+	if err := c.waitLimit(ctx, addr); err != nil {
+		return fetchError{reason: reasonRateLimit, err: err}
+	}
+
+	return getJSON(ctx, c.Client, c.Header, c.Scheme+"://"+addr, path, v, c.bytesReceived.WithLabelValues(name))
+}
+
+// getJSON requests path from the device at base, e.g. "http://host:port",
+// with header and decodes the JSON response into v. If counter isn't nil,
+// the size of the response body is added to it.
+func getJSON(ctx context.Context, client *http.Client, header http.Header, base, path string, v any, counter prometheus.Counter) error {
+	url := base + path
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, url, nil)
+	if err != nil {
+		return fetchError{reason: reasonRequest, err: fmt.Errorf("request failed: %v", err)}
+	}
+	for key, values := range header {
+		req.Header[key] = values
+	}
+
+	resp, err := client.Do(req)
+	if err != nil {
+		return fetchError{reason: reasonRequest, err: fmt.Errorf("request failed: %v", err)}
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode >= 300 && resp.StatusCode < 400 {
+		return fetchError{reason: reasonRedirect, err: fmt.Errorf("redirected to %q: %s", resp.Header.Get("Location"), resp.Status), status: resp.StatusCode}
+	}
+	if resp.StatusCode != 200 {
+		return fetchError{reason: reasonStatus, err: fmt.Errorf("non-200 response: %s", resp.Status), status: resp.StatusCode}
+	}
+
+	// Decode reads only the first JSON value, so anything a proxy appends
+	// after it is ignored. json.Unmarshal would reject the trailing data.
+	var body io.Reader = resp.Body
+	if counter != nil {
+		body = countingReader{r: resp.Body, counter: counter}
+	}
+	if err := json.NewDecoder(body).Decode(v); err != nil {
+		// Some firmware answers 200 with an empty body while rebooting.
+		if err == io.EOF {
+			return fetchError{reason: reasonEmptyBody, err: errors.New("empty response body")}
+		}
+		return fetchError{reason: reasonParse, err: fmt.Errorf("could not parse %s: %s", path, err)}
+	}
+
+	return nil
+}
+
+// countingReader adds the number of bytes read from r to counter.
+type countingReader struct {
+	r       io.Reader
+	counter prometheus.Counter
+}
+
+func (cr countingReader) Read(p []byte) (int, error) {
+	n, err := cr.r.Read(p)
+	cr.counter.Add(float64(n))
+	return n, err
+}
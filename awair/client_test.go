@@ -0,0 +1,187 @@
+package awair
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"log/slog"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// serve starts a test device that answers every request with body and
+// returns its address.
+func serve(t *testing.T, body string) string {
+	t.Helper()
+
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		io.WriteString(w, body)
+	}))
+	t.Cleanup(srv.Close)
+
+	return strings.TrimPrefix(srv.URL, "http://")
+}
+
+// newTestCollector returns a collector for the single device "a" at addr.
+func newTestCollector(addr string) *Collector {
+	return New(&http.Client{Timeout: time.Second}, map[string]string{"a": addr}, Options{})
+}
+
+// gather collects c once and returns the value of each sample by its name
+// and labels, e.g. `awair_co2{sensor="a"}`, or just its name if it has no
+// labels.
+func gather(t *testing.T, c prometheus.Collector) map[string]float64 {
+	t.Helper()
+
+	reg := prometheus.NewRegistry()
+	if err := reg.Register(c); err != nil {
+		t.Fatal(err)
+	}
+	mfs, err := reg.Gather()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	samples := make(map[string]float64)
+	for _, mf := range mfs {
+		for _, m := range mf.GetMetric() {
+			key := mf.GetName()
+			if len(m.GetLabel()) > 0 {
+				var labels []string
+				for _, label := range m.GetLabel() {
+					labels = append(labels, fmt.Sprintf("%s=%q", label.GetName(), label.GetValue()))
+				}
+				key += "{" + strings.Join(labels, ",") + "}"
+			}
+
+			switch {
+			case m.Gauge != nil:
+				samples[key] = m.GetGauge().GetValue()
+			case m.Counter != nil:
+				samples[key] = m.GetCounter().GetValue()
+			case m.Untyped != nil:
+				samples[key] = m.GetUntyped().GetValue()
+			}
+		}
+	}
+
+	return samples
+}
+
+func TestTrailingData(t *testing.T) {
+	addr := serve(t, `{"timestamp": "2026-10-16T08:00:00.000Z", "score": 92, "co2": 600}`+"\nHTTP/1.1 200 OK\r\n")
+
+	samples := gather(t, newTestCollector(addr))
+	if got := samples[`awair_co2{sensor="a"}`]; got != 600 {
+		t.Errorf("awair_co2 = %v, want 600", got)
+	}
+	if got := samples["awair_samples_collected"]; got != 1 {
+		t.Errorf("awair_samples_collected = %v, want 1", got)
+	}
+}
+
+func TestFractionalScore(t *testing.T) {
+	addr := serve(t, `{"timestamp": "2026-10-16T08:00:00.000Z", "score": 92.5}`)
+
+	c := newTestCollector(addr)
+	if got := gather(t, c)[`awair_score{sensor="a"}`]; got != 92.5 {
+		t.Errorf("awair_score = %v, want 92.5", got)
+	}
+
+	c = newTestCollector(addr)
+	c.UseScoreRatio = true
+	if got := gather(t, c)[`awair_score_ratio{sensor="a"}`]; got != 0.925 {
+		t.Errorf("awair_score_ratio = %v, want 0.925", got)
+	}
+}
+
+func TestLargeValues(t *testing.T) {
+	c := newTestCollector(serve(t, `{"timestamp": "2026-10-16T08:00:00.000Z", "voc_baseline": 3000000000, "voc_ethanol_raw": 4294967296}`))
+	c.UseRawVoc = true
+
+	samples := gather(t, c)
+	if got := samples[`awair_voc_baseline{sensor="a"}`]; got != 3000000000 {
+		t.Errorf("awair_voc_baseline = %v, want 3000000000", got)
+	}
+	if got := samples[`awair_voc_ethanol_raw{sensor="a"}`]; got != 4294967296 {
+		t.Errorf("awair_voc_ethanol_raw = %v, want 4294967296", got)
+	}
+}
+
+func TestLogAttrs(t *testing.T) {
+	var d AirData
+	if err := json.Unmarshal([]byte(`{"timestamp": "2026-10-16T08:00:00.000Z", "temp": 20, "co2": null}`), &d); err != nil {
+		t.Fatal(err)
+	}
+
+	var got []string
+	for _, attr := range d.logAttrs() {
+		got = append(got, attr.(slog.Attr).String())
+	}
+	want := []string{"timestamp=2026-10-16T08:00:00.000Z", "temp=20"}
+	if strings.Join(got, " ") != strings.Join(want, " ") {
+		t.Errorf("logAttrs() = %v, want %v", got, want)
+	}
+}
+
+// serveStatus starts a test device that answers its first failures
+// requests with status, and then with readings. It returns the device's
+// address and the number of requests it has served.
+func serveStatus(t *testing.T, status, failures int) (string, *atomic.Int32) {
+	t.Helper()
+
+	var requests atomic.Int32
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if int(requests.Add(1)) <= failures {
+			w.WriteHeader(status)
+			return
+		}
+		io.WriteString(w, `{"timestamp": "2026-10-16T08:00:00.000Z", "co2": 600}`)
+	}))
+	t.Cleanup(srv.Close)
+
+	return strings.TrimPrefix(srv.URL, "http://"), &requests
+}
+
+func TestRetryStatus(t *testing.T) {
+	addr, requests := serveStatus(t, http.StatusServiceUnavailable, 1)
+
+	c := newTestCollector(addr)
+	c.Retries = 1
+	c.RetryStatus = map[int]bool{http.StatusServiceUnavailable: true}
+
+	samples := gather(t, c)
+	if got := samples[`awair_co2{sensor="a"}`]; got != 600 {
+		t.Errorf("awair_co2 = %v, want 600", got)
+	}
+	for key := range samples {
+		if strings.HasPrefix(key, "awair_collection_errors_total") {
+			t.Errorf("unexpected series %s", key)
+		}
+	}
+	if got := requests.Load(); got != 2 {
+		t.Errorf("%d requests, want 2", got)
+	}
+}
+
+func TestNoRetryStatus(t *testing.T) {
+	addr, requests := serveStatus(t, http.StatusNotFound, 1)
+
+	c := newTestCollector(addr)
+	c.Retries = 1
+	c.RetryStatus = map[int]bool{http.StatusServiceUnavailable: true}
+
+	samples := gather(t, c)
+	if got := samples[`awair_collection_errors_total{reason="status",sensor="a"}`]; got != 1 {
+		t.Errorf("awair_collection_errors_total = %v, want 1", got)
+	}
+	if got := requests.Load(); got != 1 {
+		t.Errorf("%d requests, want 1", got)
+	}
+}
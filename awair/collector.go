@@ -0,0 +1,1466 @@
+// Package awair exports readings from Awair air quality monitors' local
+// API as Prometheus metrics.
+package awair
+
+import (
+	"context"
+	"log/slog"
+	"math"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+	"unicode"
+
+	"github.com/prometheus/client_golang/prometheus"
+	dto "github.com/prometheus/client_model/go"
+	"golang.org/x/time/rate"
+)
+
+// Collector is a prometheus.Collector that scrapes a set of devices on
+// each collection. Its exported fields may be changed before it's
+// registered.
+type Collector struct {
+	Client *http.Client
+
+	// Context is the parent of every collection's context; canceling it
+	// aborts in-flight device requests
+	Context context.Context
+
+	// CollectTimeout bounds each collection, aborting device requests that
+	// are still in flight when it expires, or not at all if zero
+	CollectTimeout time.Duration
+
+	// Header is sent with every device request
+	Header http.Header
+
+	// Scheme is the URL scheme of device requests, "http" by default
+	Scheme string
+
+	// Paths maps an endpoint to the URL path scraped for it. Endpoints
+	// that aren't in Paths are scraped from /air-data/<endpoint>.
+	Paths map[string]string
+
+	// UseScoreRatio exports the score as a 0-1 ratio rather than 0-100
+	UseScoreRatio bool
+
+	// Retries is the number of times to retry a failed request. Only
+	// requests without a response, or with a status in RetryStatus, are
+	// retried.
+	Retries     int
+	RetryStatus map[int]bool
+
+	// RateLimit and RateBurst limit the requests made to each device, or
+	// not at all if RateLimit is zero
+	RateLimit rate.Limit
+	RateBurst int
+
+	// ScrapeSettings also scrapes each device's settings, on every
+	// collect or at most once per SettingsInterval. Between scrapes the
+	// last settings are exported again.
+	ScrapeSettings   bool
+	SettingsInterval time.Duration
+
+	// UseRawVoc exports the raw VOC sensor signals
+	UseRawVoc bool
+
+	// ValueType is the type of the per-reading metrics, GaugeValue by
+	// default
+	ValueType prometheus.ValueType
+
+	// StaleNaN exports NaN for a device's readings when it can't be
+	// scraped, rather than omitting them
+	StaleNaN bool
+
+	// Warmup withholds a device's readings for this long after its first
+	// successful scrape, while its sensors stabilize
+	Warmup time.Duration
+
+	// StuckAfter is how long a device may report the same timestamp across
+	// successful scrapes before awair_data_stuck is set, 5 minutes by
+	// default
+	StuckAfter time.Duration
+
+	// UseConventionalNames also exports metrics under unit-suffixed names,
+	// e.g. awair_co2_ppm
+	UseConventionalNames bool
+
+	// DeviceAddrs maps a readable device name to its scrape addr
+	DeviceAddrs map[string]string
+
+	// Endpoints are the /air-data windows scraped from each device
+	Endpoints []string
+
+	// ModelLabel labels readings with the device model
+	ModelLabel bool
+
+	// DuplicateTargets maps an ip:port to the names of devices with
+	// different addresses that resolved to it at startup
+	DuplicateTargets map[string][]string
+
+	// DisplayNames maps each device name to the name it was configured
+	// with, if names were sanitized, for awair_sensor_info
+	DisplayNames map[string]string
+
+	// SuccessWindow is the number of recent scrapes of each device that
+	// awair_device_success_ratio covers
+	SuccessWindow int
+
+	// BestEffortDecode exports the fields of a response that decoded when
+	// others didn't, counting the failures in
+	// awair_field_decode_errors_total
+	BestEffortDecode bool
+
+	// UseErrorGaps exports the time between consecutive errors from each
+	// device as awair_time_between_errors_seconds
+	UseErrorGaps bool
+
+	errors           *prometheus.Desc
+	samplesCollected *prometheus.Desc
+	samplesExpected  *prometheus.Desc
+	devicesUp        *prometheus.Desc
+	successRatio     *prometheus.Desc
+	devicesByModel   *prometheus.Desc
+	duplicateTarget  *prometheus.Desc
+	sensorInfo       *prometheus.Desc
+	scrapeConfigInfo *prometheus.Desc
+	deadlineLeft     *prometheus.Desc
+	firmwareVersion  *prometheus.Desc
+	ledBrightness    *prometheus.Desc
+	ledMode          *prometheus.Desc
+	displayMode      *prometheus.Desc
+
+	timestamp      *prometheus.Desc
+	clockSkew      *prometheus.Desc
+	fieldsPresent  *prometheus.Desc
+	dataAge        *prometheus.Desc
+	dataStuck      *prometheus.Desc
+	score          *prometheus.Desc
+	scoreRatio     *prometheus.Desc
+	dewPointC      *prometheus.Desc
+	dewPointF      *prometheus.Desc
+	tempC          *prometheus.Desc
+	tempF          *prometheus.Desc
+	humid          *prometheus.Desc
+	absHumid       *prometheus.Desc
+	absHumidGrains *prometheus.Desc
+	co2            *prometheus.Desc
+	co2Est         *prometheus.Desc
+	co2EstBaseline *prometheus.Desc
+	voc            *prometheus.Desc
+	vocBaseline    *prometheus.Desc
+	vocH2Raw       *prometheus.Desc
+	vocEthanolRaw  *prometheus.Desc
+	pm25           *prometheus.Desc
+	pm25Aqi        *prometheus.Desc
+	pm10Est        *prometheus.Desc
+
+	// conventional maps a legacy metric to its unit-suffixed counterpart
+	conventional map[*prometheus.Desc]conventionalDesc
+
+	// bytesReceived accumulates response body sizes across scrapes
+	bytesReceived *prometheus.CounterVec
+
+	// fieldErrors counts fields that failed to decode, if BestEffortDecode
+	// is set
+	fieldErrors *prometheus.CounterVec
+
+	// errorGaps records the time between consecutive errors from a device,
+	// if UseErrorGaps is set
+	errorGaps *prometheus.HistogramVec
+
+	// sensorLabel is the name of the label holding the device name
+	sensorLabel string
+
+	mu sync.Mutex
+
+	// lastError is the time of each device's most recent error
+	lastError map[string]time.Time
+
+	// limiters holds each device address's rate limiter
+	limiters map[string]*rate.Limiter
+
+	// up records whether each device's last scrape succeeded
+	up map[string]bool
+
+	// outcomes holds the results of each device's recent scrapes
+	outcomes map[string]*outcomes
+
+	// models holds the model of each device from its last successful
+	// scrape
+	models map[string]string
+
+	// settings holds each device address's last settings and when they
+	// were scraped
+	settings map[string]scrapedSettings
+
+	// last holds the latest readings from each device endpoint, and
+	// restored marks those loaded from a state file that haven't been
+	// replaced by a live scrape
+	last     map[readingKey]savedReading
+	restored map[readingKey]bool
+
+	// lastCollect is the time the most recent collection finished
+	lastCollect time.Time
+
+	// firstContact is the time of each device address's first successful
+	// scrape
+	firstContact map[string]time.Time
+
+	// fleet holds the descriptor of each aggregate across devices
+	fleet map[FleetAggregate]*prometheus.Desc
+}
+
+// Options configures the labels on a Collector's per-reading metrics.
+type Options struct {
+	// Endpoints are the /air-data windows to scrape, "latest" by default.
+	// Readings get a window label when there's more than one.
+	Endpoints []string
+
+	// ModelLabel adds a model label to each reading.
+	ModelLabel bool
+
+	// SensorLabel names the label holding the device name, "sensor" by
+	// default.
+	SensorLabel string
+
+	// Fleet are the aggregates across devices to export.
+	Fleet []FleetAggregate
+}
+
+// LabelNames returns the names of the labels on a Collector's metrics
+// other than the sensor label, which can't also be used for it. They
+// include le, which is reserved for histogram buckets.
+func LabelNames() []string {
+	return []string{"display_name", "endpoint", "field", "le", "mode", "model", "path", "reason", "scheme", "target", "version", "window"}
+}
+
+// NewCollector returns a collector for the latest readings of devices, a
+// map of device name to host:port, with the default options.
+func NewCollector(client *http.Client, devices map[string]string) prometheus.Collector {
+	return New(client, devices, Options{})
+}
+
+// New returns a collector for the devices in deviceAddrs, a map of device
+// name to host:port.
+func New(client *http.Client, deviceAddrs map[string]string, opts Options) *Collector {
+	if len(opts.Endpoints) == 0 {
+		opts.Endpoints = []string{"latest"}
+	}
+
+	sensor := opts.SensorLabel
+	if sensor == "" {
+		sensor = "sensor"
+	}
+
+	labels := []string{sensor}
+	if len(opts.Endpoints) > 1 {
+		labels = append(labels, "window")
+	}
+	if opts.ModelLabel {
+		labels = append(labels, "model")
+	}
+
+	c := &Collector{
+		Client:        client,
+		Context:       context.Background(),
+		Scheme:        "http",
+		ValueType:     prometheus.GaugeValue,
+		SuccessWindow: 10,
+		StuckAfter:    5 * time.Minute,
+		DeviceAddrs:   deviceAddrs,
+		Endpoints:     opts.Endpoints,
+		ModelLabel:    opts.ModelLabel,
+		sensorLabel:   sensor,
+
+		errors: prometheus.NewDesc(
+			"awair_collection_errors_total",
+			"Errors observed when collecting device metrics",
+			append(labels, "reason"),
+			nil,
+		),
+
+		samplesCollected: prometheus.NewDesc(
+			"awair_samples_collected",
+			"Number of device readings successfully collected in this scrape",
+			nil,
+			nil,
+		),
+
+		samplesExpected: prometheus.NewDesc(
+			"awair_samples_expected",
+			"Number of device readings expected in each scrape",
+			nil,
+			nil,
+		),
+
+		devicesUp: prometheus.NewDesc(
+			"awair_devices_up",
+			"Number of devices whose last scrape succeeded",
+			nil,
+			nil,
+		),
+
+		successRatio: prometheus.NewDesc(
+			"awair_device_success_ratio",
+			"Fraction of the device's recent scrapes that succeeded",
+			[]string{sensor},
+			nil,
+		),
+
+		devicesByModel: prometheus.NewDesc(
+			"awair_devices_by_model",
+			"Number of configured devices of each model, from settings or inferred from readings",
+			[]string{"model"},
+			nil,
+		),
+
+		duplicateTarget: prometheus.NewDesc(
+			"awair_duplicate_target",
+			"Set to 1 for devices whose address resolved to the same target as another device's at startup",
+			[]string{sensor, "target"},
+			nil,
+		),
+
+		deadlineLeft: prometheus.NewDesc(
+			"awair_collect_deadline_remaining_seconds",
+			"Time left before the collect timeout when the collection finished",
+			nil,
+			nil,
+		),
+
+		sensorInfo: prometheus.NewDesc(
+			"awair_sensor_info",
+			"Set to 1 for each device, with the name it was configured with",
+			[]string{sensor, "display_name"},
+			nil,
+		),
+
+		scrapeConfigInfo: prometheus.NewDesc(
+			"awair_scrape_config_info",
+			"Device endpoints the exporter is configured to scrape",
+			[]string{"endpoint", "scheme", "path"},
+			nil,
+		),
+
+		firmwareVersion: prometheus.NewDesc(
+			"awair_firmware_version",
+			"Device firmware version as major*1e6 + minor*1e3 + patch",
+			[]string{sensor, "version"},
+			nil,
+		),
+
+		ledBrightness: prometheus.NewDesc(
+			"awair_led_brightness",
+			"Brightness setting of the device's LEDs",
+			[]string{sensor},
+			nil,
+		),
+
+		ledMode: prometheus.NewDesc(
+			"awair_led_mode",
+			"Set to 1 for each device, with the mode of its LEDs, e.g. \"auto\"",
+			[]string{sensor, "mode"},
+			nil,
+		),
+
+		displayMode: prometheus.NewDesc(
+			"awair_display_mode",
+			"Set to 1 for each device, with what its display shows, e.g. \"score\"",
+			[]string{sensor, "mode"},
+			nil,
+		),
+
+		timestamp: prometheus.NewDesc(
+			"awair_data_timestamp_seconds",
+			"Time the device reported for the reading, in seconds since the epoch",
+			labels,
+			nil,
+		),
+
+		clockSkew: prometheus.NewDesc(
+			"awair_device_clock_skew_seconds",
+			"Device reading timestamp minus the time the exporter received it",
+			labels,
+			nil,
+		),
+
+		fieldsPresent: prometheus.NewDesc(
+			"awair_fields_present",
+			"Number of known sensor fields with a value in the device's response",
+			labels,
+			nil,
+		),
+
+		dataAge: prometheus.NewDesc(
+			"awair_data_age_seconds",
+			"Time since the exported readings were scraped from the device, large for readings restored from the state file",
+			labels,
+			nil,
+		),
+
+		dataStuck: prometheus.NewDesc(
+			"awair_data_stuck",
+			"Set to 1 if the device has reported the same timestamp across successful scrapes for longer than the stuck-after period, 0 otherwise",
+			labels,
+			nil,
+		),
+
+		score: prometheus.NewDesc(
+			"awair_score",
+			"Awair Score (0-100)",
+			labels,
+			nil,
+		),
+
+		scoreRatio: prometheus.NewDesc(
+			"awair_score_ratio",
+			"Awair Score (0-1)",
+			labels,
+			nil,
+		),
+
+		dewPointC: prometheus.NewDesc(
+			"awair_dew_point",
+			"The temperature at which water will condense and form into dew (C)",
+			labels,
+			nil,
+		),
+
+		dewPointF: prometheus.NewDesc(
+			"awair_dew_point_f",
+			"The temperature at which water will condense and form into dew (F)",
+			labels,
+			nil,
+		),
+
+		tempC: prometheus.NewDesc(
+			"awair_temp",
+			"Dry bulb temperature (C)",
+			labels,
+			nil,
+		),
+
+		tempF: prometheus.NewDesc(
+			"awair_temp_f",
+			"Dry bulb temperature (F)",
+			labels,
+			nil,
+		),
+
+		humid: prometheus.NewDesc(
+			"awair_humid",
+			"Relative humidity (%)",
+			labels,
+			nil,
+		),
+
+		absHumid: prometheus.NewDesc(
+			"awair_abs_humid",
+			"Absolute humidity (g/m^3)",
+			labels,
+			nil,
+		),
+
+		absHumidGrains: prometheus.NewDesc(
+			"awair_abs_humid_grains_per_lb",
+			"Absolute humidity in grains of water per pound of dry air, assuming air at 20C and sea level (g/m^3 * 7000 / 1000 / 1.2041)",
+			labels,
+			nil,
+		),
+
+		co2: prometheus.NewDesc(
+			"awair_co2",
+			"Carbon Dioxide (ppm)",
+			labels,
+			nil,
+		),
+
+		co2Est: prometheus.NewDesc(
+			"awair_co2_est",
+			"Estimated Carbon Dioxide calculated by TVOC sensor (ppm)",
+			labels,
+			nil,
+		),
+
+		co2EstBaseline: prometheus.NewDesc(
+			"awair_co2_est_baseline",
+			"A unitless value that represents the baseline from which the TVOC sensor partially derives its estimate",
+			labels,
+			nil,
+		),
+
+		voc: prometheus.NewDesc(
+			"awair_voc",
+			"Total Volatile organic compounds (ppb)",
+			labels,
+			nil,
+		),
+
+		vocBaseline: prometheus.NewDesc(
+			"awair_voc_baseline",
+			"A unitless value that represents the baseline from which the TVOC sensor partially derives its TVOC output",
+			labels,
+			nil,
+		),
+
+		vocH2Raw: prometheus.NewDesc(
+			"awair_voc_h2_raw",
+			"A unitless value that represents the Hydrogen gas signal from which the TVOC sensor partially derives its TVOC output",
+			labels,
+			nil,
+		),
+
+		vocEthanolRaw: prometheus.NewDesc(
+			"awair_voc_ethanol_raw",
+			"A unitless value that represents the Ethanol gas signal from which the TVOC sensor partially derives its TVOC output",
+			labels,
+			nil,
+		),
+
+		pm25: prometheus.NewDesc(
+			"awair_pm25",
+			"Particulate matter less than 2.5 microns in diameter (µg/m³)",
+			labels,
+			nil,
+		),
+
+		pm25Aqi: prometheus.NewDesc(
+			"awair_pm25_aqi",
+			"US EPA Air Quality Index for the PM2.5 reading (0-500)",
+			labels,
+			nil,
+		),
+
+		pm10Est: prometheus.NewDesc(
+			"awair_pm10_est",
+			"Estimated particulate matter less than 10 microns in diameter (µg/m³ - calculated by the PM2.5 sensor)",
+			labels,
+			nil,
+		),
+
+		bytesReceived: prometheus.NewCounterVec(
+			prometheus.CounterOpts{
+				Name: "awair_device_bytes_received_total",
+				Help: "Response body bytes read from the device",
+			},
+			[]string{sensor},
+		),
+
+		fieldErrors: prometheus.NewCounterVec(
+			prometheus.CounterOpts{
+				Name: "awair_field_decode_errors_total",
+				Help: "Fields in device responses that could not be decoded",
+			},
+			[]string{sensor, "field"},
+		),
+
+		errorGaps: prometheus.NewHistogramVec(
+			prometheus.HistogramOpts{
+				Name:    "awair_time_between_errors_seconds",
+				Help:    "Time between consecutive collection errors from the device",
+				Buckets: prometheus.ExponentialBuckets(10, 3, 8),
+			},
+			[]string{sensor},
+		),
+
+		lastError: make(map[string]time.Time),
+		up:        make(map[string]bool),
+		outcomes:  make(map[string]*outcomes),
+		models:    make(map[string]string),
+		settings:  make(map[string]scrapedSettings),
+		last:      make(map[readingKey]savedReading),
+		restored:  make(map[readingKey]bool),
+		limiters:  make(map[string]*rate.Limiter),
+
+		firstContact: make(map[string]time.Time),
+		fleet:        make(map[FleetAggregate]*prometheus.Desc),
+	}
+
+	for _, agg := range opts.Fleet {
+		c.fleet[agg] = newFleetDesc(agg)
+	}
+
+	c.conventional = map[*prometheus.Desc]conventionalDesc{
+		c.dewPointC: newConventionalDesc(labels, "awair_dew_point_celsius", "The temperature at which water will condense and form into dew", 1),
+		c.tempC:     newConventionalDesc(labels, "awair_temperature_celsius", "Dry bulb temperature", 1),
+		c.humid:     newConventionalDesc(labels, "awair_humidity_ratio", "Relative humidity (0-1)", 0.01),
+		c.absHumid:  newConventionalDesc(labels, "awair_absolute_humidity_grams_per_cubic_meter", "Absolute humidity", 1),
+		c.co2:       newConventionalDesc(labels, "awair_co2_ppm", "Carbon Dioxide", 1),
+		c.co2Est:    newConventionalDesc(labels, "awair_co2_estimate_ppm", "Estimated Carbon Dioxide calculated by TVOC sensor", 1),
+		c.voc:       newConventionalDesc(labels, "awair_voc_ppb", "Total Volatile organic compounds", 1),
+		c.pm25:      newConventionalDesc(labels, "awair_pm25_micrograms_per_cubic_meter", "Particulate matter less than 2.5 microns in diameter", 1),
+		c.pm10Est:   newConventionalDesc(labels, "awair_pm10_estimate_micrograms_per_cubic_meter", "Estimated particulate matter less than 10 microns in diameter (calculated by the PM2.5 sensor)", 1),
+	}
+
+	return c
+}
+
+// conventionalDesc is a parallel name for a metric that follows the
+// Prometheus unit-suffix conventions. Scale converts from the legacy value.
+type conventionalDesc struct {
+	Desc  *prometheus.Desc
+	Scale float64
+}
+
+func newConventionalDesc(labels []string, name, help string, scale float64) conventionalDesc {
+	return conventionalDesc{
+		Desc:  prometheus.NewDesc(name, help, labels, nil),
+		Scale: scale,
+	}
+}
+
+// Describe implements Prometheus.Collector.
+func (c *Collector) Describe(ch chan<- *prometheus.Desc) {
+	ch <- c.errors
+	ch <- c.samplesCollected
+	ch <- c.samplesExpected
+	ch <- c.devicesUp
+	ch <- c.successRatio
+	ch <- c.devicesByModel
+	ch <- c.duplicateTarget
+	if c.DisplayNames != nil {
+		ch <- c.sensorInfo
+	}
+	ch <- c.scrapeConfigInfo
+	if c.CollectTimeout > 0 {
+		ch <- c.deadlineLeft
+	}
+	if c.ScrapeSettings {
+		ch <- c.firmwareVersion
+		ch <- c.ledBrightness
+		ch <- c.ledMode
+		ch <- c.displayMode
+	}
+	ch <- c.fieldsPresent
+	ch <- c.dataAge
+	ch <- c.dataStuck
+	for _, desc := range c.readingDescs() {
+		ch <- desc
+	}
+	if c.UseConventionalNames {
+		for _, conv := range c.conventional {
+			ch <- conv.Desc
+		}
+	}
+	for _, desc := range c.fleet {
+		ch <- desc
+	}
+	c.bytesReceived.Describe(ch)
+	if c.BestEffortDecode {
+		c.fieldErrors.Describe(ch)
+	}
+	if c.UseErrorGaps {
+		c.errorGaps.Describe(ch)
+	}
+}
+
+// readingDescs returns the descriptors of the gauges exported for each reading.
+func (c *Collector) readingDescs() []*prometheus.Desc {
+	descs := []*prometheus.Desc{c.timestamp, c.clockSkew}
+	for _, r := range c.readings() {
+		descs = append(descs, r.Desc)
+	}
+	return descs
+}
+
+// reading is a gauge derived from a field of AirData.
+type reading struct {
+	Desc *prometheus.Desc
+
+	// Field is the JSON name of the field the value comes from
+	Field string
+	Value func(AirData) float64
+}
+
+// readings returns the gauges exported for each reading.
+func (c *Collector) readings() []reading {
+	score := reading{c.score, "score", func(d AirData) float64 { return d.Score }}
+	if c.UseScoreRatio {
+		score = reading{c.scoreRatio, "score", func(d AirData) float64 { return d.Score / 100 }}
+	}
+
+	readings := []reading{
+		score,
+		{c.dewPointC, "dew_point", func(d AirData) float64 { return d.DewPoint }},
+		{c.dewPointF, "dew_point", func(d AirData) float64 { return celsiusToFahrenheit(d.DewPoint) }},
+		{c.tempC, "temp", func(d AirData) float64 { return d.Temp }},
+		{c.tempF, "temp", func(d AirData) float64 { return celsiusToFahrenheit(d.Temp) }},
+		{c.humid, "humid", func(d AirData) float64 { return d.Humid }},
+		{c.absHumid, "abs_humid", func(d AirData) float64 { return d.AbsHumid }},
+		{c.absHumidGrains, "abs_humid", func(d AirData) float64 { return gramsPerCubicMeterToGrainsPerPound(d.AbsHumid) }},
+		{c.co2, "co2", func(d AirData) float64 { return float64(d.Co2) }},
+		{c.co2Est, "co2_est", func(d AirData) float64 { return float64(d.Co2Est) }},
+		{c.co2EstBaseline, "co2_est_baseline", func(d AirData) float64 { return float64(d.Co2EstBaseline) }},
+		{c.voc, "voc", func(d AirData) float64 { return float64(d.Voc) }},
+		{c.vocBaseline, "voc_baseline", func(d AirData) float64 { return float64(d.VocBaseline) }},
+		{c.pm25, "pm25", func(d AirData) float64 { return float64(d.Pm25) }},
+		{c.pm25Aqi, "pm25", func(d AirData) float64 { return pm25AQI(float64(d.Pm25)) }},
+		{c.pm10Est, "pm10_est", func(d AirData) float64 { return float64(d.Pm10Est) }},
+	}
+
+	if c.UseRawVoc {
+		readings = append(readings,
+			reading{c.vocEthanolRaw, "voc_ethanol_raw", func(d AirData) float64 { return float64(d.VocEthanolRaw) }},
+			reading{c.vocH2Raw, "voc_h2_raw", func(d AirData) float64 { return float64(d.VocH2Raw) }},
+		)
+	}
+
+	return readings
+}
+
+// Collect implements Prometheus.Collector.
+func (c *Collector) Collect(ch chan<- prometheus.Metric) {
+	c.collectDevices(ch, c.DeviceAddrs)
+}
+
+// Device returns a collector for just the device called name. It shares
+// c's configuration and state, e.g. rate limiters and restored readings,
+// so the device is treated the same whichever collector scrapes it.
+func (c *Collector) Device(name string) prometheus.Collector {
+	return deviceCollector{c: c, name: name}
+}
+
+// deviceCollector is a view of a Collector that scrapes one device.
+type deviceCollector struct {
+	c    *Collector
+	name string
+}
+
+// Describe implements Prometheus.Collector.
+func (d deviceCollector) Describe(ch chan<- *prometheus.Desc) {
+	d.c.Describe(ch)
+}
+
+// Collect implements Prometheus.Collector.
+func (d deviceCollector) Collect(ch chan<- prometheus.Metric) {
+	d.c.collectDevices(ch, map[string]string{d.name: d.c.DeviceAddrs[d.name]})
+}
+
+// Latest returns a view of c that sends the readings and settings from its
+// most recent scrape of each device, without scraping them again, for
+// exporters that poll on their own schedule. Readings withheld during
+// warmup are left out.
+func (c *Collector) Latest() prometheus.Collector {
+	return latestCollector{c}
+}
+
+// latestCollector is a view of a Collector that sends its latest readings.
+type latestCollector struct {
+	c *Collector
+}
+
+// Describe implements Prometheus.Collector.
+func (l latestCollector) Describe(ch chan<- *prometheus.Desc) {
+	l.c.Describe(ch)
+}
+
+// Collect implements Prometheus.Collector.
+func (l latestCollector) Collect(ch chan<- prometheus.Metric) {
+	c := l.c
+	aliases := Aliases(c.DeviceAddrs)
+	now := time.Now()
+
+	var (
+		readings []savedReading
+		cached   = make(map[string]settings)
+	)
+
+	c.mu.Lock()
+	for key, saved := range c.last {
+		if first, ok := c.firstContact[key.addr]; ok && now.Sub(first) < c.Warmup {
+			continue
+		}
+		readings = append(readings, saved)
+	}
+	for addr, scraped := range c.settings {
+		cached[addr] = scraped.settings
+	}
+	c.mu.Unlock()
+
+	for _, saved := range readings {
+		if names, ok := aliases[saved.Addr]; ok {
+			c.emitReadings(ch, names, saved.Addr, saved.Endpoint, saved.Model, saved.data(), saved.Scraped)
+		}
+	}
+	if c.ScrapeSettings {
+		for addr, s := range cached {
+			if names, ok := aliases[addr]; ok {
+				c.emitSettings(ch, names, addr, s)
+			}
+		}
+	}
+	for name, displayName := range c.DisplayNames {
+		ch <- prometheus.MustNewConstMetric(c.sensorInfo, prometheus.GaugeValue, 1, name, displayName)
+	}
+}
+
+// collectDevices sends the metrics for a scrape of deviceAddrs, some or
+// all of c.DeviceAddrs, dropping duplicates.
+func (c *Collector) collectDevices(ch chan<- prometheus.Metric, deviceAddrs map[string]string) {
+	metrics := make(chan prometheus.Metric)
+	done := make(chan struct{})
+	go func() {
+		dedupe(metrics, ch)
+		close(done)
+	}()
+
+	c.collect(metrics, deviceAddrs)
+	close(metrics)
+	<-done
+}
+
+// dedupe forwards metrics from in to out, dropping any with the same name
+// and label values as one already forwarded. A duplicate would otherwise
+// fail the whole scrape.
+func dedupe(in <-chan prometheus.Metric, out chan<- prometheus.Metric) {
+	seen := make(map[string]bool)
+
+	for m := range in {
+		var pb dto.Metric
+		if err := m.Write(&pb); err != nil {
+			out <- m
+			continue
+		}
+
+		var labels []string
+		for _, label := range pb.GetLabel() {
+			labels = append(labels, label.GetName()+"="+strconv.Quote(label.GetValue()))
+		}
+
+		key := m.Desc().String() + "{" + strings.Join(labels, ",") + "}"
+		if seen[key] {
+			slog.Warn("Dropping duplicate metric", "desc", m.Desc().String(), "labels", strings.Join(labels, ","))
+			continue
+		}
+		seen[key] = true
+		out <- m
+	}
+}
+
+// collect sends the metrics for a scrape of the devices in deviceAddrs.
+func (c *Collector) collect(ch chan<- prometheus.Metric, deviceAddrs map[string]string) {
+	var (
+		ctx    context.Context
+		cancel context.CancelFunc
+	)
+	if c.CollectTimeout > 0 {
+		ctx, cancel = context.WithTimeout(c.Context, c.CollectTimeout)
+	} else {
+		ctx, cancel = context.WithCancel(c.Context)
+	}
+	defer cancel()
+
+	var (
+		wg        sync.WaitGroup
+		collected atomic.Int32
+		expected  = len(deviceAddrs) * len(c.Endpoints)
+	)
+
+	var (
+		fleetMu sync.Mutex
+		fleet   []AirData
+	)
+
+	aliases := Aliases(deviceAddrs)
+	wg.Add(len(aliases))
+
+	for addr, names := range aliases {
+		go func(names []string, addr string) {
+			scraped, emitted, data := c.collectDevice(ctx, ch, names, addr)
+			collected.Add(int32(emitted * len(names)))
+			for _, name := range names {
+				c.setUp(name, scraped > 0)
+			}
+			if data != nil {
+				fleetMu.Lock()
+				fleet = append(fleet, *data)
+				fleetMu.Unlock()
+			}
+			wg.Done()
+		}(names, addr)
+	}
+
+	wg.Wait()
+	c.collectFleet(ch, fleet)
+
+	c.mu.Lock()
+	c.lastCollect = time.Now()
+	c.mu.Unlock()
+
+	ch <- prometheus.MustNewConstMetric(c.samplesCollected, prometheus.GaugeValue, float64(collected.Load()))
+	ch <- prometheus.MustNewConstMetric(c.samplesExpected, prometheus.GaugeValue, float64(expected))
+	ch <- prometheus.MustNewConstMetric(c.devicesUp, prometheus.GaugeValue, float64(c.countUp(deviceAddrs)))
+
+	for model, n := range c.countByModel(deviceAddrs) {
+		ch <- prometheus.MustNewConstMetric(c.devicesByModel, prometheus.GaugeValue, float64(n), model)
+	}
+
+	for name := range deviceAddrs {
+		if ratio, ok := c.recentSuccess(name); ok {
+			ch <- prometheus.MustNewConstMetric(c.successRatio, prometheus.GaugeValue, ratio, name)
+		}
+	}
+
+	for target, names := range c.DuplicateTargets {
+		for _, name := range names {
+			if _, ok := deviceAddrs[name]; ok {
+				ch <- prometheus.MustNewConstMetric(c.duplicateTarget, prometheus.GaugeValue, 1, name, target)
+			}
+		}
+	}
+
+	for name, displayName := range c.DisplayNames {
+		if _, ok := deviceAddrs[name]; ok {
+			ch <- prometheus.MustNewConstMetric(c.sensorInfo, prometheus.GaugeValue, 1, name, displayName)
+		}
+	}
+
+	for _, endpoint := range c.Endpoints {
+		ch <- prometheus.MustNewConstMetric(c.scrapeConfigInfo, prometheus.GaugeValue, 1, endpoint, c.Scheme, c.path(endpoint))
+	}
+
+	c.collectSensors(ch, c.bytesReceived, deviceAddrs)
+	if c.BestEffortDecode {
+		c.collectSensors(ch, c.fieldErrors, deviceAddrs)
+	}
+	if c.UseErrorGaps {
+		c.collectSensors(ch, c.errorGaps, deviceAddrs)
+	}
+
+	if deadline, ok := ctx.Deadline(); ok && c.CollectTimeout > 0 {
+		ch <- prometheus.MustNewConstMetric(c.deadlineLeft, prometheus.GaugeValue, time.Until(deadline).Seconds())
+	}
+}
+
+// collectSensors sends the metrics from v, which are labeled by device
+// name, for the devices in deviceAddrs.
+func (c *Collector) collectSensors(ch chan<- prometheus.Metric, v prometheus.Collector, deviceAddrs map[string]string) {
+	metrics := make(chan prometheus.Metric)
+	go func() {
+		v.Collect(metrics)
+		close(metrics)
+	}()
+
+	for m := range metrics {
+		var pb dto.Metric
+		if err := m.Write(&pb); err != nil {
+			continue
+		}
+		for _, label := range pb.GetLabel() {
+			if _, ok := deviceAddrs[label.GetValue()]; ok && label.GetName() == c.sensorLabel {
+				ch <- m
+			}
+		}
+	}
+}
+
+// Probe fetches from every device once and returns the names of those that failed.
+func (c *Collector) Probe() []string {
+	var failed []string
+
+	for name, addr := range c.DeviceAddrs {
+		for _, endpoint := range c.Endpoints {
+			if _, err := c.fetch(c.Context, name, addr, endpoint); err != nil {
+				slog.Warn("Probe failed", "sensor", name, "addr", addr, "err", err)
+				failed = append(failed, name)
+				break
+			}
+		}
+	}
+
+	sort.Strings(failed)
+	return failed
+}
+
+// collectDevice scrapes a device's settings, if enabled, and then each of
+// its endpoints, emitting the results under each of the device's names.
+// It returns the number of endpoints scraped successfully, the number
+// whose readings were emitted rather than withheld during warmup, and the
+// readings emitted from the first endpoint, if any.
+func (c *Collector) collectDevice(ctx context.Context, ch chan<- prometheus.Metric, names []string, addr string) (scraped, emitted int, first *AirData) {
+	var model string
+	if c.ScrapeSettings {
+		model = c.collectSettings(ctx, ch, names, addr)
+	}
+
+	for i, endpoint := range c.Endpoints {
+		data, ok := c.collectOne(ctx, ch, names, addr, endpoint, model)
+		if ok {
+			scraped++
+		}
+		if data != nil {
+			emitted++
+		}
+		if i == 0 {
+			first = data
+		}
+	}
+
+	return scraped, emitted, first
+}
+
+// scrapedSettings is a device's settings and the time they were scraped.
+type scrapedSettings struct {
+	settings
+	scraped time.Time
+}
+
+// collectSettings scrapes a single device's settings, or reuses those
+// scraped within c.SettingsInterval, and returns its model, if known.
+// Failures are logged and otherwise ignored, since older firmware may not
+// report settings. If a refresh fails, the last settings scraped are
+// exported instead.
+func (c *Collector) collectSettings(ctx context.Context, ch chan<- prometheus.Metric, names []string, addr string) string {
+	c.mu.Lock()
+	cached, ok := c.settings[addr]
+	c.mu.Unlock()
+
+	s := cached.settings
+	if !ok || time.Since(cached.scraped) >= c.SettingsInterval {
+		fetched, err := c.fetchSettings(ctx, names[0], addr)
+		switch {
+		case err != nil && !ok:
+			slog.Warn("Settings scrape failed", "sensor", strings.Join(names, ","), "addr", addr, "err", err)
+			return ""
+		case err != nil:
+			slog.Warn("Settings scrape failed, using the last settings scraped", "sensor", strings.Join(names, ","), "addr", addr, "err", err)
+		default:
+			s = fetched
+			c.mu.Lock()
+			c.settings[addr] = scrapedSettings{s, time.Now()}
+			c.mu.Unlock()
+		}
+	}
+
+	c.emitSettings(ch, names, addr, s)
+	return s.model()
+}
+
+// emitSettings sends the metrics for a device's settings.
+func (c *Collector) emitSettings(ch chan<- prometheus.Metric, names []string, addr string, s settings) {
+	if version, ok := parseVersion(s.FwVersion); ok {
+		for _, name := range names {
+			ch <- prometheus.MustNewConstMetric(c.firmwareVersion, prometheus.GaugeValue, version, name, s.FwVersion)
+		}
+	} else if s.FwVersion != "" {
+		slog.Warn("Could not parse firmware version", "sensor", strings.Join(names, ","), "addr", addr, "version", s.FwVersion)
+	}
+
+	// Display and LED settings are skipped for firmware that doesn't
+	// report them.
+	for _, name := range names {
+		if s.LED != nil && s.LED.Brightness != nil {
+			ch <- prometheus.MustNewConstMetric(c.ledBrightness, prometheus.GaugeValue, float64(*s.LED.Brightness), name)
+		}
+		if s.LED != nil && s.LED.Mode != "" {
+			ch <- prometheus.MustNewConstMetric(c.ledMode, prometheus.GaugeValue, 1, name, s.LED.Mode)
+		}
+		if s.Display != "" {
+			ch <- prometheus.MustNewConstMetric(c.displayMode, prometheus.GaugeValue, 1, name, s.Display)
+		}
+	}
+}
+
+// collectOne scrapes a single device endpoint. It returns the readings it
+// emitted, which are nil if the scrape failed or they were withheld during
+// warmup, and reports whether the scrape succeeded. If model is empty,
+// it's inferred from the readings, or if the scrape fails, taken from the
+// last one that succeeded.
+func (c *Collector) collectOne(ctx context.Context, ch chan<- prometheus.Metric, names []string, addr, endpoint, model string) (*AirData, bool) {
+	data, err := c.fetch(ctx, names[0], addr, endpoint)
+	scraped := time.Now()
+
+	if err != nil {
+		slog.Warn("Scrape failed", "sensor", strings.Join(names, ","), "addr", addr, "err", err)
+
+		// Until a device is scraped live, readings restored from the state
+		// file stand in for NaNs.
+		saved, restored := c.restoredReading(addr, endpoint)
+
+		// There are no readings to infer the model from, so the errors and
+		// NaNs go on the series of the device's last known model.
+		if model == "" {
+			model = c.knownModel(names[0], addr, endpoint)
+		}
+		if model == "" {
+			model = "unknown"
+		}
+
+		for _, name := range names {
+			c.emitError(ch, c.labels(name, endpoint, model), err.(fetchError), !restored)
+			c.recordError(name)
+		}
+		if restored {
+			c.emitReadings(ch, names, addr, endpoint, model, saved.data(), saved.Scraped)
+		}
+		return nil, false
+	}
+
+	// If the settings couldn't be scraped, keep the model they last
+	// reported, since the readings can't tell an Element from others.
+	if model == "" && c.ScrapeSettings {
+		model = c.knownModel(names[0], addr, endpoint)
+	}
+	if model == "" {
+		model = data.model()
+	}
+
+	for _, name := range names {
+		c.setModel(name, model)
+	}
+	unchanged := c.remember(addr, endpoint, model, data, scraped)
+
+	if slog.Default().Enabled(ctx, slog.LevelDebug) {
+		attrs := []any{"sensor", strings.Join(names, ","), "addr", addr, "endpoint", endpoint}
+		slog.Debug("Scraped readings", append(attrs, data.logAttrs()...)...)
+	}
+
+	if c.Warmup > 0 && c.warmingUp(addr, scraped) {
+		slog.Debug("Withholding readings during warmup", "sensor", strings.Join(names, ","), "addr", addr)
+		return nil, true
+	}
+
+	c.emitReadings(ch, names, addr, endpoint, model, data, scraped)
+
+	// A device whose clock or sensors have wedged can keep answering with
+	// the same readings, which up and the status code don't show. Scrapes
+	// closer together than the device's update period see the same
+	// timestamp too, so it must be unchanged for a while.
+	stuck := 0.0
+	if unchanged > c.StuckAfter {
+		stuck = 1
+	}
+	for _, name := range names {
+		c.gauge(ch, c.dataStuck, stuck, c.labels(name, endpoint, model)...)
+	}
+
+	return &data, true
+}
+
+// sameTimestamp reports whether a and b have the same valid timestamp.
+func sameTimestamp(a, b AirData) bool {
+	if a.invalid["timestamp"] || b.invalid["timestamp"] {
+		return false
+	}
+	ta, errA := time.Parse(time.RFC3339, a.Timestamp)
+	tb, errB := time.Parse(time.RFC3339, b.Timestamp)
+	return errA == nil && errB == nil && ta.Equal(tb)
+}
+
+// emitReadings sends the metrics for data, scraped from a device endpoint
+// at the time scraped, under each of the device's names.
+func (c *Collector) emitReadings(ch chan<- prometheus.Metric, names []string, addr, endpoint, model string, data AirData, scraped time.Time) {
+	var (
+		timestamp time.Time
+		err       error
+	)
+	if !data.invalid["timestamp"] {
+		timestamp, err = time.Parse(time.RFC3339, data.Timestamp)
+		if err != nil {
+			slog.Warn("Could not parse timestamp", "sensor", strings.Join(names, ","), "addr", addr, "timestamp", data.Timestamp, "err", err)
+		}
+	}
+
+	for _, name := range names {
+		labels := c.labels(name, endpoint, model)
+
+		if !timestamp.IsZero() {
+			c.gauge(ch, c.timestamp, float64(timestamp.UnixNano())/1e9, labels...)
+			c.gauge(ch, c.clockSkew, timestamp.Sub(scraped).Seconds(), labels...)
+		}
+		c.gauge(ch, c.fieldsPresent, float64(len(data.present)), labels...)
+		c.gauge(ch, c.dataAge, time.Since(scraped).Seconds(), labels...)
+
+		for _, r := range c.readings() {
+			if data.invalid[r.Field] {
+				continue
+			}
+			c.gauge(ch, r.Desc, r.Value(data), labels...)
+		}
+	}
+}
+
+// emitError sends the metrics for a failed scrape, including NaN readings
+// if c.StaleNaN and staleNaN are set.
+func (c *Collector) emitError(ch chan<- prometheus.Metric, labels []string, err fetchError, staleNaN bool) {
+	if err.reason != reasonRequest {
+		ch <- prometheus.MustNewConstMetric(c.errors, prometheus.CounterValue, 1, append(labels, err.reason)...)
+	}
+
+	if c.StaleNaN && staleNaN {
+		for _, desc := range c.readingDescs() {
+			c.gauge(ch, desc, math.NaN(), labels...)
+		}
+	}
+}
+
+// labels returns the label values for a reading.
+func (c *Collector) labels(name, endpoint, model string) []string {
+	labels := []string{name}
+	if len(c.Endpoints) > 1 {
+		labels = append(labels, endpoint)
+	}
+	if c.ModelLabel {
+		labels = append(labels, model)
+	}
+	return labels
+}
+
+// Aliases maps each address in deviceAddrs to the sorted names
+// configured for it. A device with several names is scraped once.
+func Aliases(deviceAddrs map[string]string) map[string][]string {
+	aliases := make(map[string][]string)
+	for name, addr := range deviceAddrs {
+		aliases[addr] = append(aliases[addr], name)
+	}
+	for _, names := range aliases {
+		sort.Strings(names)
+	}
+	return aliases
+}
+
+// setUp records whether the device's latest scrape succeeded.
+func (c *Collector) setUp(name string, up bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.up[name] = up
+
+	o, ok := c.outcomes[name]
+	if !ok {
+		o = &outcomes{}
+		c.outcomes[name] = o
+	}
+	o.add(up, c.SuccessWindow)
+}
+
+// setModel records the device's model.
+func (c *Collector) setModel(name, model string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.models[name] = model
+}
+
+// lastModel returns the device's model from its last successful scrape,
+// or "" if it hasn't been scraped successfully.
+func (c *Collector) lastModel(name string) string {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.models[name]
+}
+
+// knownModel returns the device's model from its last successful scrape,
+// or from the readings of addr's endpoint restored from the state file,
+// or "" if neither is known.
+func (c *Collector) knownModel(name, addr, endpoint string) string {
+	if model := c.lastModel(name); model != "" {
+		return model
+	}
+	if saved, ok := c.restoredReading(addr, endpoint); ok {
+		return saved.Model
+	}
+	return ""
+}
+
+// countByModel returns the number of devices in deviceAddrs of each
+// model. Devices that haven't been scraped successfully count as
+// "unknown".
+func (c *Collector) countByModel(deviceAddrs map[string]string) map[string]int {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	counts := make(map[string]int)
+	for name := range deviceAddrs {
+		model := c.models[name]
+		if model == "" {
+			model = "unknown"
+		}
+		counts[model]++
+	}
+	return counts
+}
+
+// recentSuccess returns the fraction of the device's recent scrapes that
+// succeeded, if it has been scraped.
+func (c *Collector) recentSuccess(name string) (float64, bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	o, ok := c.outcomes[name]
+	if !ok || len(o.results) == 0 {
+		return 0, false
+	}
+
+	var n int
+	for _, up := range o.results {
+		if up {
+			n++
+		}
+	}
+	return float64(n) / float64(len(o.results)), true
+}
+
+// outcomes is a ring buffer of a device's most recent scrape results.
+type outcomes struct {
+	results []bool
+
+	// next is the index of the oldest result, once results is full
+	next int
+}
+
+// add records a scrape result, replacing the oldest once there are size.
+func (o *outcomes) add(up bool, size int) {
+	if len(o.results) < size {
+		o.results = append(o.results, up)
+		return
+	}
+
+	o.results[o.next] = up
+	o.next = (o.next + 1) % len(o.results)
+}
+
+// countUp returns the number of devices in deviceAddrs whose last
+// scrape succeeded.
+func (c *Collector) countUp(deviceAddrs map[string]string) int {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	var n int
+	for name := range deviceAddrs {
+		if c.up[name] {
+			n++
+		}
+	}
+	return n
+}
+
+// warmingUp records the device's first successful scrape, if now is it,
+// and reports whether now is within c.Warmup of it.
+func (c *Collector) warmingUp(addr string, now time.Time) bool {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	first, ok := c.firstContact[addr]
+	if !ok {
+		first = now
+		c.firstContact[addr] = first
+	}
+	return now.Sub(first) < c.Warmup
+}
+
+// Status returns the number of devices whose last scrape succeeded and
+// failed, and the time the last collection finished. Devices that haven't
+// been scraped yet count as failed, and the time is zero before the first
+// collection.
+func (c *Collector) Status() (up, down int, lastCollect time.Time) {
+	up = c.countUp(c.DeviceAddrs)
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return up, len(c.DeviceAddrs) - up, c.lastCollect
+}
+
+// recordError observes the time since the device's previous error, if any.
+func (c *Collector) recordError(name string) {
+	now := time.Now()
+
+	c.mu.Lock()
+	last, ok := c.lastError[name]
+	c.lastError[name] = now
+	c.mu.Unlock()
+
+	if ok {
+		c.errorGaps.WithLabelValues(name).Observe(now.Sub(last).Seconds())
+	}
+}
+
+// gauge sends a per-reading metric of type c.ValueType for desc, along with
+// its conventionally named counterpart if there is one and they're enabled.
+func (c *Collector) gauge(ch chan<- prometheus.Metric, desc *prometheus.Desc, value float64, labels ...string) {
+	ch <- prometheus.MustNewConstMetric(desc, c.ValueType, value, labels...)
+
+	if conv, ok := c.conventional[desc]; ok && c.UseConventionalNames {
+		ch <- prometheus.MustNewConstMetric(conv.Desc, c.ValueType, value*conv.Scale, labels...)
+	}
+}
+
+// parseVersion maps a dotted version string like "1.2.8" to a comparable
+// number, major*1e6 + minor*1e3 + patch. A leading "v" and any trailing
+// non-numeric text in a component ("8-beta") are ignored; missing
+// components are zero.
+func parseVersion(version string) (float64, bool) {
+	parts := strings.SplitN(strings.TrimPrefix(version, "v"), ".", 3)
+
+	var value float64
+	for i := 0; i < 3; i++ {
+		value *= 1000
+		if i >= len(parts) {
+			continue
+		}
+
+		digits := parts[i]
+		if end := strings.IndexFunc(digits, func(r rune) bool { return !unicode.IsDigit(r) }); end >= 0 {
+			digits = digits[:end]
+		}
+
+		n, err := strconv.Atoi(digits)
+		if err != nil || n >= 1000 {
+			return 0, false
+		}
+		value += float64(n)
+	}
+
+	return value, true
+}
+
+// pm25Breakpoints are the US EPA's PM2.5 concentration (µg/m³) ranges for
+// each AQI range, as revised in 2024.
+var pm25Breakpoints = []struct {
+	cLo, cHi float64
+	iLo, iHi float64
+}{
+	{0, 9.0, 0, 50},
+	{9.1, 35.4, 51, 100},
+	{35.5, 55.4, 101, 150},
+	{55.5, 125.4, 151, 200},
+	{125.5, 225.4, 201, 300},
+	{225.5, 325.4, 301, 500},
+}
+
+// pm25AQI converts a PM2.5 concentration in µg/m³ to the US EPA AQI by
+// linear interpolation within its breakpoint range. Concentrations above
+// the top breakpoint are reported as the maximum AQI, 500.
+func pm25AQI(c float64) float64 {
+	// The EPA truncates concentrations to one decimal place.
+	c = math.Trunc(c*10) / 10
+
+	for _, bp := range pm25Breakpoints {
+		if c <= bp.cHi {
+			if c < bp.cLo {
+				c = bp.cLo
+			}
+			return math.Round((bp.iHi-bp.iLo)/(bp.cHi-bp.cLo)*(c-bp.cLo) + bp.iLo)
+		}
+	}
+
+	return 500
+}
+
+// dryAirDensity is the density of dry air at 20C and 101.325 kPa, in kg/m³.
+const dryAirDensity = 1.2041
+
+// gramsPerCubicMeterToGrainsPerPound converts absolute humidity in g/m³ to
+// grains of water per pound of dry air. Dividing by the density of dry air
+// gives grams per kilogram, and there are 7000 grains in a pound, so 7
+// grains/lb per g/kg. The air is assumed to be at 20C and sea level;
+// the result is about 1% off for every 3C or 100m away from that.
+func gramsPerCubicMeterToGrainsPerPound(absHumid float64) float64 {
+	return absHumid / dryAirDensity * 7
+}
+
+func celsiusToFahrenheit(tempC float64) float64 {
+	return tempC*9/5 + 32
+}
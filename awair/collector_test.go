@@ -0,0 +1,248 @@
+package awair
+
+import (
+	"math"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"golang.org/x/time/rate"
+)
+
+func TestModelOnError(t *testing.T) {
+	var fail atomic.Bool
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if fail.Load() {
+			http.Error(w, "rebooting", http.StatusServiceUnavailable)
+			return
+		}
+		w.Write([]byte(`{"timestamp": "2026-10-16T08:00:00.000Z", "temp": 21.5, "lux": 120}`))
+	}))
+	defer srv.Close()
+
+	c := New(&http.Client{Timeout: time.Second}, map[string]string{"a": strings.TrimPrefix(srv.URL, "http://")}, Options{ModelLabel: true})
+	c.StaleNaN = true
+
+	if got := gather(t, c)[`awair_temp{model="awair-omni",sensor="a"}`]; got != 21.5 {
+		t.Fatalf("awair_temp = %v, want 21.5", got)
+	}
+
+	fail.Store(true)
+	samples := gather(t, c)
+	if got, ok := samples[`awair_temp{model="awair-omni",sensor="a"}`]; !ok || !math.IsNaN(got) {
+		t.Errorf("awair_temp = %v, want NaN on the awair-omni series", got)
+	}
+	if got := samples[`awair_collection_errors_total{model="awair-omni",reason="status",sensor="a"}`]; got != 1 {
+		t.Errorf("awair_collection_errors_total = %v, want 1 on the awair-omni series", got)
+	}
+	for key := range samples {
+		if strings.Contains(key, `model="unknown"`) && strings.Contains(key, `sensor="a"`) {
+			t.Errorf("unexpected series %s", key)
+		}
+	}
+}
+
+// serveSettings starts a test Awair Element whose settings requests fail
+// while fail is set, and returns its address.
+func serveSettings(t *testing.T, fail *atomic.Bool) string {
+	t.Helper()
+
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/settings/config/data" {
+			w.Write([]byte(`{"timestamp": "2026-10-16T08:00:00.000Z", "temp": 21.5}`))
+			return
+		}
+		if fail.Load() {
+			http.Error(w, "busy", http.StatusServiceUnavailable)
+			return
+		}
+		w.Write([]byte(`{"device_uuid": "awair-element_1234", "fw_version": "1.2.8", "display": "score", "led": {"mode": "manual", "brightness": 179}}`))
+	}))
+	t.Cleanup(srv.Close)
+
+	return strings.TrimPrefix(srv.URL, "http://")
+}
+
+func TestSettingsKeptOnError(t *testing.T) {
+	var fail atomic.Bool
+	c := newTestCollector(serveSettings(t, &fail))
+	c.ScrapeSettings = true
+
+	gather(t, c)
+
+	fail.Store(true)
+	samples := gather(t, c)
+	want := map[string]float64{
+		`awair_firmware_version{sensor="a",version="1.2.8"}`: 1002008,
+		`awair_led_brightness{sensor="a"}`:                   179,
+		`awair_led_mode{mode="manual",sensor="a"}`:           1,
+		`awair_display_mode{mode="score",sensor="a"}`:        1,
+	}
+	for key, value := range want {
+		if got, ok := samples[key]; !ok || got != value {
+			t.Errorf("%s = %v, want %v", key, got, value)
+		}
+	}
+}
+
+func TestSettingsModelOnError(t *testing.T) {
+	var fail atomic.Bool
+	addr := serveSettings(t, &fail)
+	c := New(&http.Client{Timeout: time.Second}, map[string]string{"a": addr}, Options{ModelLabel: true})
+	c.ScrapeSettings = true
+
+	gather(t, c)
+
+	fail.Store(true)
+	samples := gather(t, c)
+	if got := samples[`awair_temp{model="awair-element",sensor="a"}`]; got != 21.5 {
+		t.Errorf("awair_temp = %v, want 21.5 on the awair-element series", got)
+	}
+	for key := range samples {
+		if strings.Contains(key, `model="unknown"`) && strings.Contains(key, `sensor="a"`) {
+			t.Errorf("unexpected series %s", key)
+		}
+	}
+
+	// Without cached settings, the model comes from the state file.
+	var state strings.Builder
+	if err := c.SaveState(&state); err != nil {
+		t.Fatal(err)
+	}
+	restarted := New(&http.Client{Timeout: time.Second}, map[string]string{"a": addr}, Options{ModelLabel: true})
+	restarted.ScrapeSettings = true
+	if err := restarted.LoadState(strings.NewReader(state.String())); err != nil {
+		t.Fatal(err)
+	}
+	if got := gather(t, restarted)[`awair_temp{model="awair-element",sensor="a"}`]; got != 21.5 {
+		t.Errorf("awair_temp = %v after a restart, want 21.5 on the awair-element series", got)
+	}
+}
+
+func TestLatest(t *testing.T) {
+	addr, requests := serveStatus(t, http.StatusOK, 0)
+	c := newTestCollector(addr)
+
+	if got := gather(t, c.Latest())[`awair_co2{sensor="a"}`]; got != 0 {
+		t.Errorf("awair_co2 = %v before a scrape, want none", got)
+	}
+
+	gather(t, c)
+	if got := gather(t, c.Latest())[`awair_co2{sensor="a"}`]; got != 600 {
+		t.Errorf("awair_co2 = %v, want 600", got)
+	}
+	if got := requests.Load(); got != 1 {
+		t.Errorf("%d requests, want 1", got)
+	}
+}
+
+func TestPm25AQI(t *testing.T) {
+	tests := []struct {
+		c   float64
+		aqi float64
+	}{
+		{0, 0},
+		{9.0, 50},
+		{9.1, 51},
+		{12.0, 56},
+		{35.4, 100},
+		{35.5, 101},
+		{55.4, 150},
+		{55.5, 151},
+		{125.4, 200},
+		{125.5, 201},
+		{225.4, 300},
+		{225.5, 301},
+		{325.4, 500},
+
+		// Concentrations are truncated to one decimal place.
+		{9.09, 50},
+
+		// Concentrations above the table are clamped.
+		{325.5, 500},
+		{1000, 500},
+	}
+
+	for _, tt := range tests {
+		if got := pm25AQI(tt.c); got != tt.aqi {
+			t.Errorf("pm25AQI(%v) = %v, want %v", tt.c, got, tt.aqi)
+		}
+	}
+}
+
+func TestWarmupNotCollected(t *testing.T) {
+	c := newTestCollector(serve(t, `{"timestamp": "2026-10-16T08:00:00.000Z", "co2": 600}`))
+	c.Warmup = time.Hour
+
+	samples := gather(t, c)
+	if _, ok := samples[`awair_co2{sensor="a"}`]; ok {
+		t.Error("awair_co2 exported during warmup")
+	}
+	if got := samples["awair_samples_collected"]; got != 0 {
+		t.Errorf("awair_samples_collected = %v, want 0", got)
+	}
+	if got := samples["awair_devices_up"]; got != 1 {
+		t.Errorf("awair_devices_up = %v, want 1", got)
+	}
+}
+
+func TestDeviceSharesState(t *testing.T) {
+	body := `{"timestamp": "2026-10-16T08:00:00.000Z", "co2": 600}`
+	c := New(&http.Client{Timeout: time.Second}, map[string]string{"a": serve(t, body), "b": serve(t, body)}, Options{})
+	c.RateLimit = rate.Every(time.Hour)
+	c.RateBurst = 1
+
+	if got := gather(t, c)[`awair_co2{sensor="a"}`]; got != 600 {
+		t.Fatalf("awair_co2 = %v, want 600", got)
+	}
+
+	// The device's view uses the same rate limiter, which is now empty.
+	samples := gather(t, c.Device("a"))
+	if got := samples[`awair_collection_errors_total{reason="rate_limited",sensor="a"}`]; got != 1 {
+		t.Errorf("awair_collection_errors_total{reason=\"rate_limited\"} = %v, want 1", got)
+	}
+	for key := range samples {
+		if strings.Contains(key, `sensor="b"`) {
+			t.Errorf("device a's view exported %s", key)
+		}
+	}
+	if got := samples["awair_samples_expected"]; got != 1 {
+		t.Errorf("awair_samples_expected = %v, want 1", got)
+	}
+}
+
+func TestDuplicateMetricDropped(t *testing.T) {
+	c := newTestCollector(serve(t, `{"timestamp": "2026-10-16T08:00:00.000Z", "co2": 600}`))
+
+	// Listing a device twice sends its awair_duplicate_target twice, which
+	// would fail the whole gather.
+	c.DuplicateTargets = map[string][]string{"192.0.2.1:80": {"a", "a"}}
+
+	samples := gather(t, c)
+	if got := samples[`awair_duplicate_target{sensor="a",target="192.0.2.1:80"}`]; got != 1 {
+		t.Errorf("awair_duplicate_target = %v, want 1", got)
+	}
+	if got := samples[`awair_co2{sensor="a"}`]; got != 600 {
+		t.Errorf("awair_co2 = %v, want 600", got)
+	}
+}
+
+func TestDataStuck(t *testing.T) {
+	c := newTestCollector(serve(t, `{"timestamp": "2026-10-16T08:00:00.000Z", "co2": 600}`))
+
+	// Scrapes in quick succession see the same timestamp from a healthy
+	// device.
+	for i := 0; i < 2; i++ {
+		if got := gather(t, c)[`awair_data_stuck{sensor="a"}`]; got != 0 {
+			t.Errorf("scrape %d: awair_data_stuck = %v, want 0", i, got)
+		}
+	}
+
+	c.StuckAfter = time.Nanosecond
+	if got := gather(t, c)[`awair_data_stuck{sensor="a"}`]; got != 1 {
+		t.Errorf("awair_data_stuck = %v, want 1", got)
+	}
+}
@@ -0,0 +1,236 @@
+package awair
+
+import (
+	"crypto/md5"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"hash"
+	"io"
+	"net/http"
+	"strings"
+	"sync"
+)
+
+// DigestTransport is an http.RoundTripper that answers HTTP digest
+// authentication challenges (RFC 7616) with Username and Password. Each
+// host's latest challenge is remembered, so only the first request to a
+// host, or one whose nonce has expired, is sent twice.
+type DigestTransport struct {
+	Username string
+	Password string
+
+	// Transport makes the requests, http.DefaultTransport if nil
+	Transport http.RoundTripper
+
+	mu sync.Mutex
+
+	// challenges holds the latest challenge from each host
+	challenges map[string]*digestChallenge
+}
+
+// digestChallenge holds the parameters of a WWW-Authenticate: Digest header.
+type digestChallenge struct {
+	realm     string
+	nonce     string
+	opaque    string
+	algorithm string
+	qop       string
+
+	// nc counts the requests made with nonce
+	nc int
+}
+
+// RoundTrip implements http.RoundTripper.
+func (t *DigestTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	t.mu.Lock()
+	challenge := t.challenges[req.URL.Host]
+	t.mu.Unlock()
+
+	first := req
+	if challenge != nil {
+		first = t.authorize(req, challenge)
+	}
+
+	resp, err := t.transport().RoundTrip(first)
+	if err != nil || resp.StatusCode != http.StatusUnauthorized {
+		return resp, err
+	}
+
+	challenge = parseDigestChallenge(resp.Header.Values("WWW-Authenticate"))
+	if challenge == nil || (req.Body != nil && req.GetBody == nil) {
+		return resp, nil
+	}
+
+	retry := req.Clone(req.Context())
+	if req.GetBody != nil {
+		if retry.Body, err = req.GetBody(); err != nil {
+			return resp, nil
+		}
+	}
+	io.Copy(io.Discard, resp.Body)
+	resp.Body.Close()
+
+	t.mu.Lock()
+	if t.challenges == nil {
+		t.challenges = make(map[string]*digestChallenge)
+	}
+	t.challenges[req.URL.Host] = challenge
+	t.mu.Unlock()
+
+	return t.transport().RoundTrip(t.authorize(retry, challenge))
+}
+
+func (t *DigestTransport) transport() http.RoundTripper {
+	if t.Transport == nil {
+		return http.DefaultTransport
+	}
+	return t.Transport
+}
+
+// authorize returns a copy of req with an Authorization header answering
+// challenge.
+func (t *DigestTransport) authorize(req *http.Request, challenge *digestChallenge) *http.Request {
+	t.mu.Lock()
+	challenge.nc++
+	nc := fmt.Sprintf("%08x", challenge.nc)
+	t.mu.Unlock()
+
+	var buf [8]byte
+	rand.Read(buf[:])
+	cnonce := hex.EncodeToString(buf[:])
+
+	algorithm := strings.ToUpper(challenge.algorithm)
+	h := digestHash(algorithm)
+	uri := req.URL.RequestURI()
+
+	ha1 := h(t.Username + ":" + challenge.realm + ":" + t.Password)
+	if strings.HasSuffix(algorithm, "-SESS") {
+		ha1 = h(ha1 + ":" + challenge.nonce + ":" + cnonce)
+	}
+	ha2 := h(req.Method + ":" + uri)
+
+	fields := []string{
+		fmt.Sprintf("username=%q", t.Username),
+		fmt.Sprintf("realm=%q", challenge.realm),
+		fmt.Sprintf("nonce=%q", challenge.nonce),
+		fmt.Sprintf("uri=%q", uri),
+	}
+	if challenge.algorithm != "" {
+		fields = append(fields, "algorithm="+challenge.algorithm)
+	}
+	if challenge.qop == "" {
+		fields = append(fields, fmt.Sprintf("response=%q", h(ha1+":"+challenge.nonce+":"+ha2)))
+	} else {
+		response := h(ha1 + ":" + challenge.nonce + ":" + nc + ":" + cnonce + ":" + challenge.qop + ":" + ha2)
+		fields = append(fields,
+			fmt.Sprintf("response=%q", response),
+			"qop="+challenge.qop,
+			"nc="+nc,
+			fmt.Sprintf("cnonce=%q", cnonce),
+		)
+	}
+	if challenge.opaque != "" {
+		fields = append(fields, fmt.Sprintf("opaque=%q", challenge.opaque))
+	}
+
+	req = req.Clone(req.Context())
+	req.Header.Set("Authorization", "Digest "+strings.Join(fields, ", "))
+	return req
+}
+
+// digestHash returns a function computing the hex digest of a string for
+// algorithm, or nil if it isn't supported.
+func digestHash(algorithm string) func(string) string {
+	var newHash func() hash.Hash
+	switch strings.TrimSuffix(algorithm, "-SESS") {
+	case "", "MD5":
+		newHash = md5.New
+	case "SHA-256":
+		newHash = sha256.New
+	default:
+		return nil
+	}
+
+	return func(s string) string {
+		h := newHash()
+		io.WriteString(h, s)
+		return hex.EncodeToString(h.Sum(nil))
+	}
+}
+
+// parseDigestChallenge returns the first supported Digest challenge among
+// the WWW-Authenticate header values, or nil if there isn't one.
+func parseDigestChallenge(values []string) *digestChallenge {
+	for _, value := range values {
+		scheme, rest, _ := strings.Cut(strings.TrimSpace(value), " ")
+		if !strings.EqualFold(scheme, "Digest") {
+			continue
+		}
+
+		params := parseAuthParams(rest)
+		challenge := &digestChallenge{
+			realm:     params["realm"],
+			nonce:     params["nonce"],
+			opaque:    params["opaque"],
+			algorithm: params["algorithm"],
+		}
+		if challenge.nonce == "" || digestHash(strings.ToUpper(challenge.algorithm)) == nil {
+			continue
+		}
+
+		// Only "auth" protection is supported. A challenge offering just
+		// "auth-int" can't be answered.
+		if qop, ok := params["qop"]; ok {
+			for _, q := range strings.Split(qop, ",") {
+				if strings.TrimSpace(q) == "auth" {
+					challenge.qop = "auth"
+				}
+			}
+			if challenge.qop == "" {
+				continue
+			}
+		}
+
+		return challenge
+	}
+
+	return nil
+}
+
+// parseAuthParams parses a comma-separated list of key=value parameters
+// from a WWW-Authenticate header, where values may be quoted strings.
+// Keys are lowercased.
+func parseAuthParams(s string) map[string]string {
+	params := make(map[string]string)
+
+	for s = strings.TrimSpace(s); s != ""; s = strings.TrimSpace(s) {
+		key, rest, ok := strings.Cut(s, "=")
+		if !ok {
+			break
+		}
+		key = strings.ToLower(strings.TrimSpace(key))
+		rest = strings.TrimSpace(rest)
+
+		if !strings.HasPrefix(rest, `"`) {
+			value, next, _ := strings.Cut(rest, ",")
+			params[key] = strings.TrimSpace(value)
+			s = next
+			continue
+		}
+
+		var value strings.Builder
+		i := 1
+		for ; i < len(rest) && rest[i] != '"'; i++ {
+			if rest[i] == '\\' && i+1 < len(rest) {
+				i++
+			}
+			value.WriteByte(rest[i])
+		}
+		params[key] = value.String()
+		_, s, _ = strings.Cut(rest[min(i+1, len(rest)):], ",")
+	}
+
+	return params
+}
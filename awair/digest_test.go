@@ -0,0 +1,145 @@
+package awair
+
+import (
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+)
+
+// digestServer is a test device that requires digest authentication as
+// "user" with password "secret".
+type digestServer struct {
+	algorithm string
+
+	mu         sync.Mutex
+	nonce      string
+	requests   int
+	challenges int
+	nc         string
+}
+
+func (s *digestServer) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.requests++
+	if !s.authorized(r) {
+		s.challenges++
+		w.Header().Set("WWW-Authenticate", fmt.Sprintf(`Digest realm="awair", qop="auth", algorithm=%s, nonce=%q, opaque="xyz"`, s.algorithm, s.nonce))
+		w.WriteHeader(http.StatusUnauthorized)
+		return
+	}
+	io.WriteString(w, "ok")
+}
+
+// authorized reports whether r's Authorization header answers the current
+// challenge.
+func (s *digestServer) authorized(r *http.Request) bool {
+	scheme, rest, _ := strings.Cut(r.Header.Get("Authorization"), " ")
+	if scheme != "Digest" {
+		return false
+	}
+
+	params := parseAuthParams(rest)
+	if params["nonce"] != s.nonce || params["opaque"] != "xyz" || params["qop"] != "auth" || params["uri"] != r.URL.RequestURI() {
+		return false
+	}
+
+	h := digestHash(s.algorithm)
+	ha1 := h("user:awair:secret")
+	ha2 := h(r.Method + ":" + r.URL.RequestURI())
+	if params["response"] != h(ha1+":"+s.nonce+":"+params["nc"]+":"+params["cnonce"]+":auth:"+ha2) {
+		return false
+	}
+
+	s.nc = params["nc"]
+	return true
+}
+
+// counts returns the number of requests s has served, how many of them
+// were challenged, and the nc of the last one authorized.
+func (s *digestServer) counts() (requests, challenges int, nc string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.requests, s.challenges, s.nc
+}
+
+func TestDigestTransport(t *testing.T) {
+	for _, algorithm := range []string{"MD5", "SHA-256"} {
+		t.Run(algorithm, func(t *testing.T) {
+			s := &digestServer{algorithm: algorithm, nonce: "n1"}
+			srv := httptest.NewServer(s)
+			defer srv.Close()
+
+			client := &http.Client{Transport: &DigestTransport{Username: "user", Password: "secret"}}
+			get := func() {
+				t.Helper()
+				resp, err := client.Get(srv.URL + "/air-data/latest?x=1")
+				if err != nil {
+					t.Fatal(err)
+				}
+				resp.Body.Close()
+				if resp.StatusCode != http.StatusOK {
+					t.Fatalf("status = %d, want 200", resp.StatusCode)
+				}
+			}
+
+			get()
+			if requests, challenges, _ := s.counts(); requests != 2 || challenges != 1 {
+				t.Errorf("first request: %d requests and %d challenges, want 2 and 1", requests, challenges)
+			}
+
+			// The cached challenge answers the next request up front.
+			get()
+			if requests, challenges, nc := s.counts(); requests != 3 || challenges != 1 || nc != "00000002" {
+				t.Errorf("second request: %d requests, %d challenges and nc %s, want 3, 1 and 00000002", requests, challenges, nc)
+			}
+
+			// A stale nonce is challenged again, and the new one is used.
+			s.mu.Lock()
+			s.nonce = "n2"
+			s.mu.Unlock()
+			get()
+			if requests, challenges, nc := s.counts(); requests != 5 || challenges != 2 || nc != "00000001" {
+				t.Errorf("stale nonce: %d requests, %d challenges and nc %s, want 5, 2 and 00000001", requests, challenges, nc)
+			}
+		})
+	}
+}
+
+func TestDigestTransportWrongPassword(t *testing.T) {
+	srv := httptest.NewServer(&digestServer{algorithm: "MD5", nonce: "n1"})
+	defer srv.Close()
+
+	client := &http.Client{Transport: &DigestTransport{Username: "user", Password: "wrong"}}
+	resp, err := client.Get(srv.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusUnauthorized {
+		t.Errorf("status = %d, want 401", resp.StatusCode)
+	}
+}
+
+func TestParseAuthParams(t *testing.T) {
+	got := parseAuthParams(`Realm="a, b", nonce="x\"y\\z", qop=auth, algorithm=MD5`)
+	want := map[string]string{
+		"realm":     "a, b",
+		"nonce":     `x"y\z`,
+		"qop":       "auth",
+		"algorithm": "MD5",
+	}
+	if len(got) != len(want) {
+		t.Errorf("parseAuthParams = %q, want %q", got, want)
+	}
+	for key, value := range want {
+		if got[key] != value {
+			t.Errorf("parseAuthParams[%q] = %q, want %q", key, got[key], value)
+		}
+	}
+}
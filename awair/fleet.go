@@ -0,0 +1,141 @@
+package awair
+
+import (
+	"fmt"
+	"math"
+	"reflect"
+	"strings"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// FleetAggregate is a summary of one reading across every device that was
+// scraped successfully, exported as awair_fleet_<Field>_<Func>.
+type FleetAggregate struct {
+	// Field is the JSON name of an AirData reading, e.g. "temp"
+	Field string
+
+	// Func is one of "avg", "min" or "max"
+	Func string
+}
+
+// ParseFleet parses a comma-separated list of field_func aggregates, e.g.
+// "temp_avg,co2_max".
+func ParseFleet(list string) ([]FleetAggregate, error) {
+	var aggs []FleetAggregate
+
+	for _, spec := range strings.Split(list, ",") {
+		if spec = strings.TrimSpace(spec); spec == "" {
+			continue
+		}
+
+		index := strings.LastIndex(spec, "_")
+		if index < 0 {
+			return nil, fmt.Errorf("expected field_func, got %q", spec)
+		}
+		agg := FleetAggregate{Field: spec[:index], Func: spec[index+1:]}
+
+		if _, ok := airDataFields[agg.Field]; !ok {
+			return nil, fmt.Errorf("unknown field %q in %q", agg.Field, spec)
+		}
+		switch agg.Func {
+		case "avg", "min", "max":
+		default:
+			return nil, fmt.Errorf("unknown aggregate %q in %q, expected avg, min or max", agg.Func, spec)
+		}
+
+		aggs = append(aggs, agg)
+	}
+
+	return aggs, nil
+}
+
+// newFleetDesc returns the descriptor of agg's gauge.
+func newFleetDesc(agg FleetAggregate) *prometheus.Desc {
+	return prometheus.NewDesc(
+		"awair_fleet_"+agg.Field+"_"+agg.Func,
+		fmt.Sprintf("The %s of %s across devices scraped successfully", agg.Func, agg.Field),
+		nil,
+		nil,
+	)
+}
+
+// airDataFields maps the JSON name of each AirData reading, every field
+// but Timestamp, to its index in the struct.
+var airDataFields = func() map[string]int {
+	fields := make(map[string]int)
+
+	t := reflect.TypeOf(AirData{})
+	for i := 0; i < t.NumField(); i++ {
+		name, _, _ := strings.Cut(t.Field(i).Tag.Get("json"), ",")
+		if name == "" || name == "timestamp" {
+			continue
+		}
+		fields[name] = i
+	}
+
+	return fields
+}()
+
+// field returns the value of the reading with the JSON name field, if it
+// was present and decoded.
+func (d AirData) field(name string) (float64, bool) {
+	i, ok := airDataFields[name]
+	if !ok || !d.present[name] || d.invalid[name] {
+		return 0, false
+	}
+
+	v := reflect.ValueOf(d).Field(i)
+	if v.Kind() == reflect.Pointer {
+		if v.IsNil() {
+			return 0, false
+		}
+		v = v.Elem()
+	}
+
+	switch v.Kind() {
+	case reflect.Int64:
+		return float64(v.Int()), true
+	case reflect.Float64:
+		return v.Float(), true
+	default:
+		return 0, false
+	}
+}
+
+// collectFleet sends the fleet aggregates of data, the readings of each
+// device scraped successfully. Aggregates with no readings are omitted.
+func (c *Collector) collectFleet(ch chan<- prometheus.Metric, data []AirData) {
+	for agg, desc := range c.fleet {
+		var (
+			n     int
+			sum   float64
+			value float64
+		)
+		for _, d := range data {
+			v, ok := d.field(agg.Field)
+			if !ok {
+				continue
+			}
+
+			switch {
+			case n == 0:
+				value = v
+			case agg.Func == "min":
+				value = math.Min(value, v)
+			case agg.Func == "max":
+				value = math.Max(value, v)
+			}
+			sum += v
+			n++
+		}
+
+		if n == 0 {
+			continue
+		}
+		if agg.Func == "avg" {
+			value = sum / float64(n)
+		}
+		ch <- prometheus.MustNewConstMetric(desc, prometheus.GaugeValue, value)
+	}
+}
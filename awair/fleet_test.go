@@ -0,0 +1,33 @@
+package awair
+
+import (
+	"net/http"
+	"testing"
+	"time"
+)
+
+func TestFleetMissingFields(t *testing.T) {
+	fleet, err := ParseFleet("co2_min,co2_avg,temp_avg")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Only b reports co2, so a's absent reading mustn't count as zero.
+	deviceAddrs := map[string]string{
+		"a": serve(t, `{"timestamp": "2026-10-16T08:00:00.000Z", "temp": 20}`),
+		"b": serve(t, `{"timestamp": "2026-10-16T08:00:00.000Z", "temp": 22, "co2": 600}`),
+	}
+	c := New(&http.Client{Timeout: time.Second}, deviceAddrs, Options{Fleet: fleet})
+
+	samples := gather(t, c)
+	want := map[string]float64{
+		"awair_fleet_co2_min":  600,
+		"awair_fleet_co2_avg":  600,
+		"awair_fleet_temp_avg": 21,
+	}
+	for key, value := range want {
+		if got, ok := samples[key]; !ok || got != value {
+			t.Errorf("%s = %v, want %v", key, got, value)
+		}
+	}
+}
@@ -0,0 +1,157 @@
+package awair
+
+import (
+	"encoding/json"
+	"io"
+	"sort"
+	"time"
+)
+
+// readingKey identifies the readings from one endpoint of a device.
+type readingKey struct {
+	addr     string
+	endpoint string
+}
+
+// savedReading is the latest readings from one endpoint of a device, as
+// written to the state file.
+type savedReading struct {
+	Addr     string    `json:"addr"`
+	Endpoint string    `json:"endpoint"`
+	Model    string    `json:"model"`
+	Scraped  time.Time `json:"scraped"`
+	Data     AirData   `json:"data"`
+
+	// Invalid lists the fields of Data that failed to decode
+	Invalid []string `json:"invalid,omitempty"`
+
+	// Present lists the fields the device reported. Data can't carry
+	// them, since every non-pointer field is written.
+	Present []string `json:"present,omitempty"`
+
+	// since is the time of the first live scrape that reported Data's
+	// timestamp
+	since time.Time
+}
+
+// data returns the saved readings with their present and invalid fields
+// marked.
+func (s savedReading) data() AirData {
+	data := s.Data
+	data.present = make(map[string]bool)
+	for _, field := range s.Present {
+		data.present[field] = true
+	}
+	for _, field := range s.Invalid {
+		if data.invalid == nil {
+			data.invalid = make(map[string]bool)
+		}
+		data.invalid[field] = true
+	}
+	return data
+}
+
+// remember records the latest live readings from a device endpoint. It
+// returns how long the device has been reporting the same timestamp in
+// live scrapes, zero if it has just changed.
+func (c *Collector) remember(addr, endpoint, model string, data AirData, scraped time.Time) time.Duration {
+	saved := savedReading{
+		Addr:     addr,
+		Endpoint: endpoint,
+		Model:    model,
+		Scraped:  scraped,
+		Data:     data,
+	}
+	for field := range data.present {
+		saved.Present = append(saved.Present, field)
+	}
+	sort.Strings(saved.Present)
+	for field := range data.invalid {
+		saved.Invalid = append(saved.Invalid, field)
+	}
+	sort.Strings(saved.Invalid)
+
+	key := readingKey{addr, endpoint}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	saved.since = scraped
+	if prev, ok := c.last[key]; ok && !c.restored[key] && sameTimestamp(prev.Data, data) {
+		saved.since = prev.since
+	}
+
+	c.last[key] = saved
+	delete(c.restored, key)
+	return scraped.Sub(saved.since)
+}
+
+// restoredReading returns the readings from a device endpoint loaded from
+// the state file, if it hasn't been scraped live since.
+func (c *Collector) restoredReading(addr, endpoint string) (savedReading, bool) {
+	key := readingKey{addr, endpoint}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if !c.restored[key] {
+		return savedReading{}, false
+	}
+	return c.last[key], true
+}
+
+// SaveState writes the latest readings from each device endpoint to w as
+// JSON, for LoadState after a restart.
+func (c *Collector) SaveState(w io.Writer) error {
+	c.mu.Lock()
+	saved := make([]savedReading, 0, len(c.last))
+	for _, s := range c.last {
+		saved = append(saved, s)
+	}
+	c.mu.Unlock()
+
+	sort.Slice(saved, func(i, j int) bool {
+		if saved[i].Addr != saved[j].Addr {
+			return saved[i].Addr < saved[j].Addr
+		}
+		return saved[i].Endpoint < saved[j].Endpoint
+	})
+
+	enc := json.NewEncoder(w)
+	enc.SetIndent("", "  ")
+	return enc.Encode(saved)
+}
+
+// LoadState reads readings written by SaveState. Until each device
+// endpoint is scraped live, its restored readings are exported whenever
+// scraping it fails. Readings for devices and endpoints that are no
+// longer configured are ignored.
+func (c *Collector) LoadState(r io.Reader) error {
+	var saved []savedReading
+	if err := json.NewDecoder(r).Decode(&saved); err != nil {
+		return err
+	}
+
+	endpoints := make(map[string]bool)
+	for _, endpoint := range c.Endpoints {
+		endpoints[endpoint] = true
+	}
+	aliases := Aliases(c.DeviceAddrs)
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	for _, s := range saved {
+		if _, ok := aliases[s.Addr]; !ok || !endpoints[s.Endpoint] {
+			continue
+		}
+
+		key := readingKey{s.Addr, s.Endpoint}
+		if _, ok := c.last[key]; ok {
+			continue
+		}
+		c.last[key] = s
+		c.restored[key] = true
+	}
+
+	return nil
+}
@@ -0,0 +1,36 @@
+package awair
+
+import (
+	"bytes"
+	"testing"
+)
+
+func TestStateFieldsPresent(t *testing.T) {
+	addr := serve(t, `{"timestamp": "2026-10-16T08:00:00.000Z", "temp": 21.5, "co2": 600}`)
+
+	c := newTestCollector(addr)
+	if got := gather(t, c)[`awair_fields_present{sensor="a"}`]; got != 2 {
+		t.Fatalf("awair_fields_present = %v, want 2", got)
+	}
+
+	var state bytes.Buffer
+	if err := c.SaveState(&state); err != nil {
+		t.Fatal(err)
+	}
+
+	// The restored readings are exported when the device can't be
+	// scraped, here because it's been given an unusable address.
+	restored := newTestCollector(addr)
+	restored.Scheme = "invalid"
+	if err := restored.LoadState(&state); err != nil {
+		t.Fatal(err)
+	}
+
+	samples := gather(t, restored)
+	if got := samples[`awair_fields_present{sensor="a"}`]; got != 2 {
+		t.Errorf("restored awair_fields_present = %v, want 2", got)
+	}
+	if got := samples[`awair_co2{sensor="a"}`]; got != 600 {
+		t.Errorf("restored awair_co2 = %v, want 600", got)
+	}
+}
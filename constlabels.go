@@ -0,0 +1,121 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"os"
+	"os/signal"
+	"sort"
+	"strings"
+	"sync"
+	"syscall"
+
+	"github.com/prometheus/client_golang/prometheus"
+	dto "github.com/prometheus/client_model/go"
+)
+
+// constLabels holds labels added to every exported metric, read from a
+// JSON object of label names to values, e.g. {"site": "home"}.
+type constLabels struct {
+	filename string
+
+	// reserved holds the names of labels the registry's metrics already
+	// have, which would collide
+	reserved map[string]bool
+
+	mu     sync.Mutex
+	labels []*dto.LabelPair
+}
+
+// newConstLabels reads the labels in filename, which may not use any of
+// the reserved label names.
+func newConstLabels(filename string, reserved []string) (*constLabels, error) {
+	l := &constLabels{filename: filename, reserved: make(map[string]bool)}
+	for _, name := range reserved {
+		l.reserved[name] = true
+	}
+
+	if err := l.load(); err != nil {
+		return nil, err
+	}
+	return l, nil
+}
+
+// load reads the labels from l's file, replacing the current ones only if
+// they're all valid.
+func (l *constLabels) load() error {
+	buf, err := os.ReadFile(l.filename)
+	if err != nil {
+		return err
+	}
+
+	var m map[string]string
+	if err := json.Unmarshal(buf, &m); err != nil {
+		return fmt.Errorf("%s: %v", l.filename, err)
+	}
+
+	labels := make([]*dto.LabelPair, 0, len(m))
+	for name, value := range m {
+		if !labelNameRE.MatchString(name) || strings.HasPrefix(name, "__") {
+			return fmt.Errorf("%s: invalid label name %q", l.filename, name)
+		}
+		if l.reserved[name] {
+			return fmt.Errorf("%s: label %q is already used by the exporter's metrics", l.filename, name)
+		}
+		name, value := name, value
+		labels = append(labels, &dto.LabelPair{Name: &name, Value: &value})
+	}
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.labels = labels
+	return nil
+}
+
+// reloadOnHUP reloads the labels each time the process gets SIGHUP. If
+// the file is invalid, the current labels are kept.
+func (l *constLabels) reloadOnHUP() {
+	hup := make(chan os.Signal, 1)
+	signal.Notify(hup, syscall.SIGHUP)
+
+	for range hup {
+		if err := l.load(); err != nil {
+			slog.Error("Error reloading -const-labels-file, keeping current labels", "err", err)
+			continue
+		}
+		slog.Info("Reloaded constant labels", "file", l.filename)
+	}
+}
+
+// gatherer returns a Gatherer that adds the labels to every metric
+// gathered from g. A metric that already has one of the labels is an
+// error.
+func (l *constLabels) gatherer(g prometheus.Gatherer) prometheus.Gatherer {
+	return prometheus.GathererFunc(func() ([]*dto.MetricFamily, error) {
+		mfs, err := g.Gather()
+
+		l.mu.Lock()
+		labels := l.labels
+		l.mu.Unlock()
+
+		for _, mf := range mfs {
+			for _, m := range mf.GetMetric() {
+				for _, label := range m.GetLabel() {
+					for _, cl := range labels {
+						if label.GetName() == cl.GetName() {
+							return nil, fmt.Errorf("metric %s already has constant label %q", mf.GetName(), cl.GetName())
+						}
+					}
+				}
+
+				m.Label = append(m.Label, labels...)
+				sort.Slice(m.Label, func(i, j int) bool {
+					return m.Label[i].GetName() < m.Label[j].GetName()
+				})
+			}
+		}
+
+		return mfs, err
+	})
+}
@@ -1,36 +1,133 @@
 package main
 
 import (
-	"encoding/json"
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
 	"flag"
 	"fmt"
-	"log"
+	"io"
+	"log/slog"
+	"net"
 	"net/http"
 	"os"
+	"os/signal"
+	"path/filepath"
+	"regexp"
+	"slices"
+	"sort"
+	"strconv"
 	"strings"
 	"sync"
+	"syscall"
+	"text/template"
 	"time"
+	"unicode/utf8"
 
+	"github.com/coreos/go-systemd/v22/activation"
 	"github.com/prometheus/client_golang/prometheus"
 	"github.com/prometheus/client_golang/prometheus/collectors"
 	"github.com/prometheus/client_golang/prometheus/promhttp"
+	"github.com/prometheus/client_golang/prometheus/push"
+	dto "github.com/prometheus/client_model/go"
+	"github.com/pteichman/awair_exporter/awair"
+	"golang.org/x/time/rate"
 )
 
 func main() {
 	var (
-		flagAddress = flag.String("address", "localhost:8888", "Listen address")
+		flagAddress          = flag.String("address", envOr("AWAIR_LISTEN_ADDRESS", "localhost:8888"), "Listen address, unless a socket is passed by systemd (env AWAIR_LISTEN_ADDRESS)")
+		flagLogLevel         = flag.String("log.level", "info", "Only log messages with the given severity or above: debug, info, warn, error")
+		flagLogFormat        = flag.String("log.format", "logfmt", "Output format of log messages: logfmt, json")
+		flagContentType      = flag.String("content-type", "", "Content-Type to send with /metrics responses, replacing the negotiated one")
+		flagHeaderFile       = flag.String("device-header-file", "", "File of \"Name: value\" lines to send with device requests")
+		flagRequireAll       = flag.Bool("require-all-devices", false, "Exit at startup if any device can't be scraped")
+		flagScoreRatio       = flag.Bool("score-ratio", false, "Export the score as awair_score_ratio (0-1) instead of awair_score")
+		flagConvNames        = flag.Bool("conventional-names", false, "Also export metrics with Prometheus unit-suffixed names")
+		flagEndpoint         = flag.String("endpoint", "latest", "Comma-separated /air-data windows to scrape, e.g. latest,15-min-avg")
+		flagSettings         = flag.Bool("settings", false, "Also scrape each device's settings, for its firmware version, model, and display and LED settings")
+		flagModelLabel       = flag.Bool("model-label", false, "Label readings with the device model, from its settings or inferred from its readings")
+		flagErrorGaps        = flag.Bool("error-gap-histogram", false, "Export a histogram of the time between each device's errors")
+		flagStaleNaN         = flag.Bool("stale-nan", false, "Export NaN for a device's readings when it can't be scraped")
+		flagSourceAddr       = flag.String("source-addr", "", "Local IP address to make device requests from")
+		flagBestEffort       = flag.Bool("best-effort-decode", false, "Decode device responses field by field, exporting the fields that parse")
+		flagMaxAliases       = flag.Int("max-aliases", 2, "Maximum number of names that may share one device address")
+		flagRawVoc           = flag.Bool("raw-voc", false, "Export the raw VOC sensor signals, awair_voc_h2_raw and awair_voc_ethanol_raw")
+		flagStrictTargets    = flag.Bool("strict-targets", false, "Exit at startup if different device addresses resolve to the same target")
+		flagRetries          = flag.Int("retries", 0, "Number of times to retry a failed device request")
+		flagRetryStatus      = flag.String("retry-on-status", "502,503,504", "Comma-separated HTTP statuses to retry; other non-200 statuses fail immediately")
+		flagRateLimit        = flag.Float64("device-rate-limit", 0, "Maximum requests per minute to each device, or 0 for no limit")
+		flagRateBurst        = flag.Int("device-rate-burst", 1, "Requests allowed to each device in a burst under -device-rate-limit")
+		flagSensorLabel      = flag.String("sensor-label-name", "sensor", "Name of the label holding the device name")
+		flagMaxDevices       = flag.Int("max-devices", 0, "Maximum number of devices to accept, or 0 for no limit")
+		flagRedirects        = flag.String("redirects", "follow", "How to handle device redirects: follow, error, follow-same-host-only")
+		flagHeartbeat        = flag.Duration("heartbeat-interval", 0, "Interval between log lines summarizing device status, or 0 for none")
+		flagDigestUser       = flag.String("digest-username", "", "Username for devices behind HTTP digest authentication")
+		flagDigestPassFile   = flag.String("digest-password-file", "", "File holding the password for -digest-username")
+		flagWarmup           = flag.Duration("warmup", 0, "Time to withhold a device's readings after its first successful scrape")
+		flagPushURL          = flag.String("pushgateway-url", "", "Pushgateway URL to also push metrics to on -push-interval")
+		flagPushJob          = flag.String("push-job", "awair", "Job name for metrics pushed to the Pushgateway")
+		flagPushGrouping     = flag.String("push-grouping", "", "Comma-separated name=value grouping labels for metrics pushed to the Pushgateway")
+		flagPushInterval     = flag.Duration("push-interval", time.Minute, "Interval between pushes to the Pushgateway")
+		flagSanitize         = flag.Bool("sanitize-names", false, "Lowercase device names and replace characters other than a-z, 0-9 and _ with _, exporting the originals in awair_sensor_info")
+		flagCollectTimeout   = flag.Duration("collect-timeout", 0, "Time allowed for each collection across all devices, or 0 for no limit")
+		flagScheme           = flag.String("scheme", "http", "URL scheme of device requests: http, https")
+		flagTLSCert          = flag.String("device-tls-cert", "", "PEM client certificate to present to devices over https")
+		flagTLSKey           = flag.String("device-tls-key", "", "PEM private key for -device-tls-cert")
+		flagTLSCA            = flag.String("device-tls-ca", "", "PEM CA certificates to verify devices with, instead of the system roots")
+		flagFleet            = flag.String("fleet", "", "Comma-separated aggregates across devices to export as awair_fleet_<field>_<func>, e.g. temp_avg,co2_max")
+		flagMetricType       = flag.String("metric-type", "gauge", "Type of the per-reading metrics: gauge, untyped")
+		flagSuccessWindow    = flag.Int("success-window", 10, "Number of recent scrapes of each device that awair_device_success_ratio covers")
+		flagPerDevice        = flag.Bool("per-device-endpoints", false, "Also serve each device's metrics from its own registry at /metrics/<name>")
+		flagPathTemplate     = flag.String("path-template", "/air-data/{{.Window}}", "Template for the URL path scraped for each -endpoint window")
+		flagScrapeTimeout    = flag.Duration("scrape-timeout", 2*time.Second, "Time allowed for each device request, including reading the response, and at most what remains of -collect-timeout, or 0 for no limit")
+		flagConnectTimeout   = flag.Duration("connect-timeout", 2*time.Second, "Time allowed to connect to a device, at most -scrape-timeout, or 0 for no limit")
+		flagStateFile        = flag.String("state-file", "", "File to save the latest readings to on shutdown, and restore them from on startup until devices are scraped live")
+		flagStatsdAddr       = flag.String("statsd-addr", "", "host:port of a statsd server to also send readings to on -statsd-interval")
+		flagStatsdInterval   = flag.Duration("statsd-interval", time.Minute, "Interval between sending the latest readings to statsd")
+		flagSettingsInterval = flag.Duration("settings-interval", 0, "With -settings, scrape each device's settings at most this often, or 0 for every collect")
+		flagConstLabelsFile  = flag.String("const-labels-file", "", "JSON file of label names to values added to every metric, reread on SIGHUP; YAML isn't supported")
+		flagStuckAfter       = flag.Duration("stuck-after", 5*time.Minute, "Time a device may report the same reading timestamp before awair_data_stuck is set")
+		deviceHeaders        = make(headerFlag)
+
+		flagReadHeaderTimeout = flag.Duration("read-header-timeout", 5*time.Second, "Time allowed to read request headers")
+		flagReadTimeout       = flag.Duration("read-timeout", 10*time.Second, "Time allowed to read an entire request")
+		flagWriteTimeout      = flag.Duration("write-timeout", 30*time.Second, "Time allowed to write a response")
+		flagShutdownTimeout   = flag.Duration("shutdown-timeout", 5*time.Second, "Time allowed for in-flight requests to finish on shutdown")
 	)
 
+	flag.Var(deviceHeaders, "device-header", "Header to send with device requests, as \"Name: value\" (repeatable)")
 	flag.Parse()
 
+	logger, err := newLogger(os.Stderr, *flagLogLevel, *flagLogFormat)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(1)
+	}
+	slog.SetDefault(logger)
+
 	if flag.NArg() == 0 {
-		log.Println("No devices specified.")
+		slog.Error("No devices specified")
 		os.Exit(1)
 	}
 
 	devices, err := parseDevices(flag.Args())
 	if err != nil {
-		log.Printf("Error parsing devices: %s", err)
+		slog.Error("Error parsing devices", "err", err)
+		os.Exit(1)
+	}
+
+	var displayNames map[string]string
+	if *flagSanitize {
+		if devices, displayNames, err = sanitizeNames(devices); err != nil {
+			slog.Error("Error sanitizing device names", "err", err)
+			os.Exit(1)
+		}
+	}
+
+	if *flagMaxDevices > 0 && len(devices) > *flagMaxDevices {
+		slog.Error("Too many devices", "devices", len(devices), "max", *flagMaxDevices)
 		os.Exit(1)
 	}
 
@@ -39,16 +136,628 @@ func main() {
 		deviceAddrs[name] = addr
 	}
 
-	client := http.Client{Timeout: 2 * time.Second}
+	for addr, names := range awair.Aliases(deviceAddrs) {
+		if len(names) > *flagMaxAliases {
+			slog.Error("Too many names for one device", "addr", addr, "sensors", strings.Join(names, ", "), "max", *flagMaxAliases)
+			os.Exit(1)
+		}
+	}
+
+	if !labelNameRE.MatchString(*flagSensorLabel) || strings.HasPrefix(*flagSensorLabel, "__") {
+		slog.Error("Invalid -sensor-label-name", "name", *flagSensorLabel)
+		os.Exit(1)
+	}
+	if slices.Contains(awair.LabelNames(), *flagSensorLabel) {
+		slog.Error("-sensor-label-name is already used by the exporter's metrics", "name", *flagSensorLabel, "reserved", strings.Join(awair.LabelNames(), ", "))
+		os.Exit(1)
+	}
+
+	valueTypes := map[string]prometheus.ValueType{
+		"gauge":   prometheus.GaugeValue,
+		"untyped": prometheus.UntypedValue,
+	}
+	valueType, ok := valueTypes[*flagMetricType]
+	if !ok {
+		slog.Error("Invalid -metric-type", "type", *flagMetricType)
+		os.Exit(1)
+	}
+
+	if *flagSuccessWindow < 1 {
+		slog.Error("Invalid -success-window", "window", *flagSuccessWindow)
+		os.Exit(1)
+	}
+
+	// A limit without a burst of at least one would block every request.
+	if *flagRateLimit < 0 || (*flagRateLimit > 0 && *flagRateBurst < 1) {
+		slog.Error("Invalid -device-rate-limit", "limit", *flagRateLimit, "burst", *flagRateBurst)
+		os.Exit(1)
+	}
+
+	endpoints, err := parseEndpoints(*flagEndpoint)
+	if err != nil {
+		slog.Error("Invalid -endpoint", "err", err)
+		os.Exit(1)
+	}
+
+	paths, err := renderPaths(*flagPathTemplate, endpoints)
+	if err != nil {
+		slog.Error("Error rendering -path-template", "err", err)
+		os.Exit(1)
+	}
+
+	fleet, err := awair.ParseFleet(*flagFleet)
+	if err != nil {
+		slog.Error("Error parsing -fleet", "err", err)
+		os.Exit(1)
+	}
+
+	retryStatus, err := parseStatusCodes(*flagRetryStatus)
+	if err != nil {
+		slog.Error("Error parsing -retry-on-status", "err", err)
+		os.Exit(1)
+	}
+
+	if *flagHeaderFile != "" {
+		if err := deviceHeaders.readFile(*flagHeaderFile); err != nil {
+			slog.Error("Error reading device headers", "err", err)
+			os.Exit(1)
+		}
+	}
+
+	// ctx is canceled on shutdown, aborting any in-flight device requests.
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+
+	if *flagScrapeTimeout > 0 && *flagConnectTimeout > *flagScrapeTimeout {
+		slog.Error("-connect-timeout is longer than -scrape-timeout", "connect_timeout", *flagConnectTimeout, "scrape_timeout", *flagScrapeTimeout)
+		os.Exit(1)
+	}
+
+	dialer := &net.Dialer{Timeout: *flagConnectTimeout, KeepAlive: 30 * time.Second}
+	if *flagSourceAddr != "" {
+		ip := net.ParseIP(*flagSourceAddr)
+		if ip == nil {
+			slog.Error("Invalid source address", "addr", *flagSourceAddr)
+			os.Exit(1)
+		}
+		dialer.LocalAddr = &net.TCPAddr{IP: ip}
+	}
+
+	transport := http.DefaultTransport.(*http.Transport).Clone()
+	transport.DialContext = dialer.DialContext
+
+	if *flagScheme != "http" && *flagScheme != "https" {
+		slog.Error("Invalid -scheme", "scheme", *flagScheme)
+		os.Exit(1)
+	}
+
+	tlsConfig, err := deviceTLSConfig(*flagTLSCert, *flagTLSKey, *flagTLSCA)
+	if err != nil {
+		slog.Error("Error loading device TLS configuration", "err", err)
+		os.Exit(1)
+	}
+	if tlsConfig != nil {
+		transport.TLSClientConfig = tlsConfig
+	}
+
+	client := &http.Client{Transport: transport, Timeout: *flagScrapeTimeout}
+
+	if *flagDigestUser != "" {
+		password, err := os.ReadFile(*flagDigestPassFile)
+		if err != nil {
+			slog.Error("Error reading -digest-password-file", "err", err)
+			os.Exit(1)
+		}
+		client.Transport = &awair.DigestTransport{
+			Username:  *flagDigestUser,
+			Password:  strings.TrimRight(string(password), "\r\n"),
+			Transport: transport,
+		}
+	}
+
+	client.CheckRedirect, err = redirectPolicy(*flagRedirects)
+	if err != nil {
+		slog.Error("Invalid -redirects policy", "policy", *flagRedirects)
+		os.Exit(1)
+	}
 
 	reg := prometheus.NewRegistry()
 	reg.MustRegister(collectors.NewProcessCollector(collectors.ProcessCollectorOpts{}))
 	reg.MustRegister(collectors.NewGoCollector())
-	reg.MustRegister(newCollector(client, deviceAddrs))
 
-	log.Printf("Awair exporter listening on %s", *flagAddress)
-	http.Handle("/metrics", promhttp.HandlerFor(reg, promhttp.HandlerOpts{}))
-	log.Fatal(http.ListenAndServe(*flagAddress, nil))
+	c := awair.New(client, deviceAddrs, awair.Options{
+		Endpoints:   endpoints,
+		ModelLabel:  *flagModelLabel,
+		SensorLabel: *flagSensorLabel,
+		Fleet:       fleet,
+	})
+	c.Context = ctx
+	c.CollectTimeout = *flagCollectTimeout
+	c.Header = http.Header(deviceHeaders)
+	c.Scheme = *flagScheme
+	c.Paths = paths
+	c.UseScoreRatio = *flagScoreRatio
+	c.UseConventionalNames = *flagConvNames
+	c.StaleNaN = *flagStaleNaN
+	c.SuccessWindow = *flagSuccessWindow
+	c.ValueType = valueType
+	c.DisplayNames = displayNames
+	c.Warmup = *flagWarmup
+	c.StuckAfter = *flagStuckAfter
+	c.ScrapeSettings = *flagSettings
+	c.SettingsInterval = *flagSettingsInterval
+	c.UseErrorGaps = *flagErrorGaps
+	c.BestEffortDecode = *flagBestEffort
+	c.UseRawVoc = *flagRawVoc
+	c.Retries = *flagRetries
+	c.RetryStatus = retryStatus
+	c.RateLimit = rate.Limit(*flagRateLimit / 60)
+	c.RateBurst = *flagRateBurst
+
+	dups := duplicateTargets(ctx, deviceAddrs, *flagScheme)
+	for target, names := range dups {
+		slog.Warn("Devices resolve to the same target", "target", target, "sensors", strings.Join(names, ", "))
+	}
+	if len(dups) > 0 && *flagStrictTargets {
+		os.Exit(1)
+	}
+	c.DuplicateTargets = dups
+
+	if err := reg.Register(c); err != nil {
+		slog.Error("Error registering collector", "err", err)
+		os.Exit(1)
+	}
+
+	if *flagStateFile != "" {
+		loadState(c, *flagStateFile)
+	}
+
+	if *flagHeartbeat > 0 {
+		go heartbeat(ctx, c, *flagHeartbeat)
+	}
+
+	if *flagRequireAll {
+		if failed := c.Probe(); len(failed) > 0 {
+			slog.Error("Unreachable devices", "sensors", strings.Join(failed, ", "))
+			os.Exit(1)
+		}
+	}
+
+	var grouping map[string]string
+	if *flagPushURL != "" {
+		var err error
+		if grouping, err = parseGrouping(*flagPushGrouping); err != nil {
+			slog.Error("Invalid -push-grouping", "err", err)
+			os.Exit(1)
+		}
+	}
+
+	var (
+		labels   *constLabels
+		gatherer prometheus.Gatherer = reg
+	)
+	if *flagConstLabelsFile != "" {
+		var err error
+		// quantile is on the Go collector's summaries.
+		reserved := append(awair.LabelNames(), *flagSensorLabel, "quantile")
+
+		// The Pushgateway adds job and the grouping labels to every metric
+		// pushed to it.
+		if *flagPushURL != "" {
+			reserved = append(reserved, "job")
+			for name := range grouping {
+				reserved = append(reserved, name)
+			}
+		}
+
+		labels, err = newConstLabels(*flagConstLabelsFile, reserved)
+		if err != nil {
+			slog.Error("Invalid -const-labels-file", "err", err)
+			os.Exit(1)
+		}
+		go labels.reloadOnHUP()
+		gatherer = labels.gatherer(reg)
+	}
+
+	if *flagPushURL != "" {
+		pusher := push.New(*flagPushURL, *flagPushJob).Gatherer(gatherer)
+		for name, value := range grouping {
+			pusher.Grouping(name, value)
+		}
+		if err := pusher.Error(); err != nil {
+			slog.Error("Invalid -push-grouping", "err", err)
+			os.Exit(1)
+		}
+
+		pushErrors := prometheus.NewCounter(prometheus.CounterOpts{
+			Name: "awair_push_errors_total",
+			Help: "Errors pushing metrics to the Pushgateway",
+		})
+		reg.MustRegister(pushErrors)
+
+		go pushLoop(ctx, pusher, *flagPushInterval, pushErrors)
+	}
+
+	if *flagStatsdAddr != "" {
+		conn, err := net.Dial("udp", *flagStatsdAddr)
+		if err != nil {
+			slog.Error("Invalid -statsd-addr", "err", err)
+			os.Exit(1)
+		}
+
+		statsdErrors := prometheus.NewCounter(prometheus.CounterOpts{
+			Name: "awair_statsd_errors_total",
+			Help: "Errors sending readings to statsd",
+		})
+		reg.MustRegister(statsdErrors)
+
+		// statsdReg gathers only the devices' latest readings, not the
+		// process and Go metrics, so statsd doesn't scrape them again.
+		statsdReg := prometheus.NewRegistry()
+		statsdReg.MustRegister(c.Latest())
+
+		go statsdLoop(ctx, conn, statsdReg, *flagSensorLabel, *flagStatsdInterval, statsdErrors)
+	}
+
+	var metricsHandler http.Handler = filterHandler(gatherer, promhttp.HandlerOpts{})
+	if *flagContentType != "" {
+		metricsHandler = contentTypeHandler(metricsHandler, *flagContentType)
+	}
+	http.Handle("/metrics", metricsHandler)
+
+	if *flagPerDevice {
+		deviceHandlers := make(map[string]http.Handler)
+		for name := range deviceAddrs {
+			// Each device's registry holds a view of c, so it shares c's
+			// rate limiters and other per-device state.
+			deviceReg := prometheus.NewRegistry()
+			deviceReg.MustRegister(c.Device(name))
+			var deviceGatherer prometheus.Gatherer = deviceReg
+			if labels != nil {
+				deviceGatherer = labels.gatherer(deviceReg)
+			}
+			deviceHandlers[name] = filterHandler(deviceGatherer, promhttp.HandlerOpts{})
+			if *flagContentType != "" {
+				deviceHandlers[name] = contentTypeHandler(deviceHandlers[name], *flagContentType)
+			}
+		}
+		http.Handle("/metrics/", http.StripPrefix("/metrics/", deviceHandler(deviceHandlers)))
+	}
+
+	inflight := &inflightRequests{requests: make(map[*http.Request]time.Time)}
+	server := &http.Server{
+		Handler:           inflight.handler(http.DefaultServeMux),
+		ReadHeaderTimeout: *flagReadHeaderTimeout,
+		ReadTimeout:       *flagReadTimeout,
+		WriteTimeout:      *flagWriteTimeout,
+	}
+
+	shutdown := make(chan struct{})
+	go func() {
+		<-ctx.Done()
+		slog.Info("Shutting down")
+
+		shutdownCtx, cancel := context.WithTimeout(context.Background(), *flagShutdownTimeout)
+		defer cancel()
+
+		err := server.Shutdown(shutdownCtx)
+		if errors.Is(err, context.DeadlineExceeded) {
+			for r, start := range inflight.snapshot() {
+				slog.Warn("Dropping request", "method", r.Method, "path", r.URL.Path, "remote", r.RemoteAddr, "duration", time.Since(start))
+			}
+			err = server.Close()
+		}
+		if err != nil {
+			slog.Error("Error shutting down", "err", err)
+		}
+		close(shutdown)
+	}()
+
+	listener, activated, err := listen(*flagAddress)
+	if err != nil {
+		slog.Error("Error listening", "err", err)
+		os.Exit(1)
+	}
+	if activated {
+		slog.Info("Awair exporter listening on socket from systemd", "address", listener.Addr())
+	} else {
+		slog.Info("Awair exporter listening", "address", listener.Addr())
+	}
+
+	if err := server.Serve(listener); err != http.ErrServerClosed {
+		slog.Error("Error serving metrics", "err", err)
+		os.Exit(1)
+	}
+	<-shutdown
+
+	if *flagStateFile != "" {
+		if err := saveState(c, *flagStateFile); err != nil {
+			slog.Error("Error saving state", "file", *flagStateFile, "err", err)
+		}
+	}
+}
+
+// loadState restores c's readings from filename. A missing or unreadable
+// file is logged and otherwise ignored.
+func loadState(c *awair.Collector, filename string) {
+	f, err := os.Open(filename)
+	if errors.Is(err, os.ErrNotExist) {
+		slog.Info("No state file to restore", "file", filename)
+		return
+	} else if err != nil {
+		slog.Warn("Error opening state file", "file", filename, "err", err)
+		return
+	}
+	defer f.Close()
+
+	if err := c.LoadState(f); err != nil {
+		slog.Warn("Ignoring unreadable state file", "file", filename, "err", err)
+		return
+	}
+	slog.Info("Restored readings from state file", "file", filename)
+}
+
+// saveState writes c's readings to filename, replacing it atomically so a
+// crash can't leave it half-written.
+func saveState(c *awair.Collector, filename string) error {
+	f, err := os.CreateTemp(filepath.Dir(filename), filepath.Base(filename)+".*")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(f.Name())
+
+	if err := c.SaveState(f); err != nil {
+		f.Close()
+		return err
+	}
+	if err := f.Close(); err != nil {
+		return err
+	}
+	return os.Rename(f.Name(), filename)
+}
+
+// parseGrouping parses a comma-separated list of name=value Pushgateway
+// grouping labels.
+func parseGrouping(list string) (map[string]string, error) {
+	grouping := make(map[string]string)
+	for _, pair := range strings.Split(list, ",") {
+		if pair == "" {
+			continue
+		}
+		name, value, ok := strings.Cut(pair, "=")
+		if !ok {
+			return nil, fmt.Errorf("expected name=value, got %q", pair)
+		}
+		grouping[name] = value
+	}
+	return grouping, nil
+}
+
+// pushLoop pushes pusher's metrics every interval until ctx is canceled,
+// counting failed pushes in failures.
+func pushLoop(ctx context.Context, pusher *push.Pusher, interval time.Duration, failures prometheus.Counter) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ticker.C:
+		case <-ctx.Done():
+			return
+		}
+
+		if err := pusher.PushContext(ctx); err != nil {
+			slog.Warn("Error pushing metrics", "err", err)
+			failures.Inc()
+		}
+	}
+}
+
+// heartbeat logs a summary of c's device status every interval until ctx
+// is canceled.
+func heartbeat(ctx context.Context, c *awair.Collector, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ticker.C:
+		case <-ctx.Done():
+			return
+		}
+
+		up, down, lastCollect := c.Status()
+		if lastCollect.IsZero() {
+			slog.Info("Heartbeat", "up", up, "down", down, "last_collect", "never")
+		} else {
+			slog.Info("Heartbeat", "up", up, "down", down, "last_collect", lastCollect.Format(time.RFC3339))
+		}
+	}
+}
+
+// redirectPolicy returns the http.Client CheckRedirect function for a
+// -redirects policy, nil for the default of following redirects.
+func redirectPolicy(policy string) (func(*http.Request, []*http.Request) error, error) {
+	switch policy {
+	case "follow":
+		return nil, nil
+	case "error":
+		return func(*http.Request, []*http.Request) error {
+			return http.ErrUseLastResponse
+		}, nil
+	case "follow-same-host-only":
+		return sameHostRedirects, nil
+	default:
+		return nil, fmt.Errorf("unknown redirect policy %q", policy)
+	}
+}
+
+// sameHostRedirects is an http.Client CheckRedirect policy that follows
+// redirects only to the original host. Other redirects are returned as the
+// response, failing the scrape.
+func sameHostRedirects(req *http.Request, via []*http.Request) error {
+	if req.URL.Hostname() != via[0].URL.Hostname() {
+		return http.ErrUseLastResponse
+	}
+	if len(via) >= 10 {
+		return errors.New("stopped after 10 redirects")
+	}
+	return nil
+}
+
+// envOr returns the value of the environment variable key, or def if it's unset.
+func envOr(key, def string) string {
+	if value, ok := os.LookupEnv(key); ok {
+		return value
+	}
+	return def
+}
+
+// listen returns the first socket passed by systemd socket activation, if
+// any, and otherwise listens on address. It reports which was used.
+func listen(address string) (net.Listener, bool, error) {
+	listeners, err := activation.Listeners()
+	if err != nil {
+		return nil, false, err
+	}
+	if len(listeners) > 0 {
+		return listeners[0], true, nil
+	}
+
+	l, err := net.Listen("tcp", address)
+	return l, false, err
+}
+
+// newLogger returns a logger writing to w in the style of the Prometheus
+// exporters' --log.level and --log.format flags.
+func newLogger(w io.Writer, level, format string) (*slog.Logger, error) {
+	var lvl slog.Level
+	if err := lvl.UnmarshalText([]byte(level)); err != nil {
+		return nil, fmt.Errorf("unrecognized log level %q", level)
+	}
+
+	opts := &slog.HandlerOptions{Level: lvl}
+	switch format {
+	case "logfmt":
+		return slog.New(slog.NewTextHandler(w, opts)), nil
+	case "json":
+		return slog.New(slog.NewJSONHandler(w, opts)), nil
+	default:
+		return nil, fmt.Errorf("unrecognized log format %q", format)
+	}
+}
+
+// inflightRequests tracks the requests being served, so those still
+// running when shutdown times out can be logged.
+type inflightRequests struct {
+	mu sync.Mutex
+
+	// requests maps each request being served to the time it started
+	requests map[*http.Request]time.Time
+}
+
+// handler calls h, tracking each request while it's served.
+func (t *inflightRequests) handler(h http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		t.mu.Lock()
+		t.requests[r] = time.Now()
+		t.mu.Unlock()
+
+		defer func() {
+			t.mu.Lock()
+			delete(t.requests, r)
+			t.mu.Unlock()
+		}()
+
+		h.ServeHTTP(w, r)
+	})
+}
+
+// snapshot returns a copy of the requests being served.
+func (t *inflightRequests) snapshot() map[*http.Request]time.Time {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	requests := make(map[*http.Request]time.Time, len(t.requests))
+	for r, start := range t.requests {
+		requests[r] = start
+	}
+	return requests
+}
+
+// deviceHandler serves the handler in handlers named by the request path,
+// or 404 if there isn't one.
+func deviceHandler(handlers map[string]http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		h, ok := handlers[r.URL.Path]
+		if !ok {
+			http.NotFound(w, r)
+			return
+		}
+		h.ServeHTTP(w, r)
+	})
+}
+
+// filterHandler serves the metrics gathered from g. If the request has a
+// metrics query parameter, a comma-separated list of metric names, only
+// those metric families are served; the "awair_" prefix may be left off.
+func filterHandler(g prometheus.Gatherer, opts promhttp.HandlerOpts) http.Handler {
+	all := promhttp.HandlerFor(g, opts)
+
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		list := r.URL.Query().Get("metrics")
+		if list == "" {
+			all.ServeHTTP(w, r)
+			return
+		}
+
+		names := make(map[string]bool)
+		for _, name := range strings.Split(list, ",") {
+			if !metricNameRE.MatchString(name) {
+				http.Error(w, fmt.Sprintf("invalid metric name %q", name), http.StatusBadRequest)
+				return
+			}
+			names[name] = true
+			names["awair_"+name] = true
+		}
+
+		filtered := prometheus.GathererFunc(func() ([]*dto.MetricFamily, error) {
+			mfs, err := g.Gather()
+
+			var kept []*dto.MetricFamily
+			for _, mf := range mfs {
+				if names[mf.GetName()] {
+					kept = append(kept, mf)
+				}
+			}
+			return kept, err
+		})
+		promhttp.HandlerFor(filtered, opts).ServeHTTP(w, r)
+	})
+}
+
+// contentTypeHandler calls h, replacing the Content-Type it responds with.
+func contentTypeHandler(h http.Handler, contentType string) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		h.ServeHTTP(contentTypeWriter{w, contentType}, r)
+	})
+}
+
+// contentTypeWriter sets its Content-Type header just before the headers
+// are written, overriding whatever the handler set.
+type contentTypeWriter struct {
+	http.ResponseWriter
+	contentType string
+}
+
+func (w contentTypeWriter) WriteHeader(code int) {
+	w.Header().Set("Content-Type", w.contentType)
+	w.ResponseWriter.WriteHeader(code)
+}
+
+func (w contentTypeWriter) Write(p []byte) (int, error) {
+	w.Header().Set("Content-Type", w.contentType)
+	return w.ResponseWriter.Write(p)
 }
 
 // parseDevices parses a list of "key=value" strings into a map[key]value.
@@ -60,260 +769,213 @@ func parseDevices(args []string) (map[string]string, error) {
 		if index < 0 {
 			return nil, fmt.Errorf("expected key=value, got %q", arg)
 		}
+		// The name becomes the sensor label value, which must be UTF-8.
+		if !utf8.ValidString(arg[:index]) {
+			return nil, fmt.Errorf("device name is not valid UTF-8: %q", arg[:index])
+		}
 		devices[arg[:index]] = arg[index+1:]
 	}
 
 	return devices, nil
 }
 
-type collector struct {
-	Client http.Client
-
-	// DeviceAddrs maps a readable device name to its scrape addr
-	DeviceAddrs map[string]string
-
-	Errors         *prometheus.Desc
-	Score          *prometheus.Desc
-	DewPointC      *prometheus.Desc
-	DewPointF      *prometheus.Desc
-	TempC          *prometheus.Desc
-	TempF          *prometheus.Desc
-	Humid          *prometheus.Desc
-	AbsHumid       *prometheus.Desc
-	Co2            *prometheus.Desc
-	Co2Est         *prometheus.Desc
-	Co2EstBaseline *prometheus.Desc
-	Voc            *prometheus.Desc
-	VocBaseline    *prometheus.Desc
-	VocH2Raw       *prometheus.Desc
-	VocEthanolRaw  *prometheus.Desc
-	Pm25           *prometheus.Desc
-	Pm10Est        *prometheus.Desc
+// renderPaths renders the path template tmpl for each endpoint window,
+// returning a map of endpoint to URL path.
+func renderPaths(tmpl string, endpoints []string) (map[string]string, error) {
+	t, err := template.New("path").Option("missingkey=error").Parse(tmpl)
+	if err != nil {
+		return nil, err
+	}
+
+	paths := make(map[string]string)
+	for _, endpoint := range endpoints {
+		var buf strings.Builder
+		if err := t.Execute(&buf, struct{ Window string }{endpoint}); err != nil {
+			return nil, err
+		}
+		if !strings.HasPrefix(buf.String(), "/") {
+			return nil, fmt.Errorf("path %q for %s doesn't start with /", buf.String(), endpoint)
+		}
+		paths[endpoint] = buf.String()
+	}
+
+	return paths, nil
 }
 
-func newCollector(client http.Client, deviceAddrs map[string]string) *collector {
-	return &collector{
-		Client:      client,
-		DeviceAddrs: deviceAddrs,
-
-		Errors: prometheus.NewDesc(
-			"awair_collection_errors_total",
-			"Errors observed when collecting device metrics",
-			[]string{"sensor"},
-			nil,
-		),
-
-		Score: prometheus.NewDesc(
-			"awair_score",
-			"Awair Score (0-100)",
-			[]string{"sensor"},
-			nil,
-		),
-
-		DewPointC: prometheus.NewDesc(
-			"awair_dew_point",
-			"The temperature at which water will condense and form into dew (C)",
-			[]string{"sensor"},
-			nil,
-		),
-
-		DewPointF: prometheus.NewDesc(
-			"awair_dew_point_f",
-			"The temperature at which water will condense and form into dew (F)",
-			[]string{"sensor"},
-			nil,
-		),
-
-		TempC: prometheus.NewDesc(
-			"awair_temp",
-			"Dry bulb temperature (C)",
-			[]string{"sensor"},
-			nil,
-		),
-
-		TempF: prometheus.NewDesc(
-			"awair_temp_f",
-			"Dry bulb temperature (F)",
-			[]string{"sensor"},
-			nil,
-		),
-
-		Humid: prometheus.NewDesc(
-			"awair_humid",
-			"Relative humidity (%)",
-			[]string{"sensor"},
-			nil,
-		),
-
-		AbsHumid: prometheus.NewDesc(
-			"awair_abs_humid",
-			"Absolute humidity (g/m^3)",
-			[]string{"sensor"},
-			nil,
-		),
-
-		Co2: prometheus.NewDesc(
-			"awair_co2",
-			"Carbon Dioxide (ppm)",
-			[]string{"sensor"},
-			nil,
-		),
-
-		Co2Est: prometheus.NewDesc(
-			"awair_co2_est",
-			"Estimated Carbon Dioxide calculated by TVOC sensor (ppm)",
-			[]string{"sensor"},
-			nil,
-		),
-
-		Co2EstBaseline: prometheus.NewDesc(
-			"awair_co2_est_baseline",
-			"A unitless value that represents the baseline from which the TVOC sensor partially derives its estimate",
-			[]string{"sensor"},
-			nil,
-		),
-
-		Voc: prometheus.NewDesc(
-			"awair_voc",
-			"Total Volatile organic compounds (ppb)",
-			[]string{"sensor"},
-			nil,
-		),
-
-		VocBaseline: prometheus.NewDesc(
-			"awair_voc_baseline",
-			"A unitless value that represents the baseline from which the TVOC sensor partially derives its TVOC output",
-			[]string{"sensor"},
-			nil,
-		),
-
-		VocH2Raw: prometheus.NewDesc(
-			"awair_voc_h2_raw",
-			"A unitless value that represents the Hydrogen gas signal from which the TVOC sensor partially derives its TVOC output",
-			[]string{"sensor"},
-			nil,
-		),
-
-		VocEthanolRaw: prometheus.NewDesc(
-			"awair_voc_ethanol_raw",
-			"A unitless value that represents the Ethanol gas signal from which the TVOC sensor partially derives its TVOC output",
-			[]string{"sensor"},
-			nil,
-		),
-
-		Pm25: prometheus.NewDesc(
-			"awair_pm25",
-			"Particulate matter less than 2.5 microns in diameter (µg/m³)",
-			[]string{"sensor"},
-			nil,
-		),
-
-		Pm10Est: prometheus.NewDesc(
-			"awair_pm10_est",
-			"Estimated particulate matter less than 10 microns in diameter (µg/m³ - calculated by the PM2.5 sensor)",
-			[]string{"sensor"},
-			nil,
-		),
+// deviceTLSConfig returns the TLS configuration for device requests from
+// PEM files: a client certificate and key, and CA certificates to verify
+// devices with. It returns nil if none are given.
+func deviceTLSConfig(certFile, keyFile, caFile string) (*tls.Config, error) {
+	if certFile == "" && keyFile == "" && caFile == "" {
+		return nil, nil
+	}
+
+	config := &tls.Config{}
+
+	if certFile != "" || keyFile != "" {
+		cert, err := tls.LoadX509KeyPair(certFile, keyFile)
+		if err != nil {
+			return nil, err
+		}
+		config.Certificates = []tls.Certificate{cert}
+	}
+
+	if caFile != "" {
+		buf, err := os.ReadFile(caFile)
+		if err != nil {
+			return nil, err
+		}
+		config.RootCAs = x509.NewCertPool()
+		if !config.RootCAs.AppendCertsFromPEM(buf) {
+			return nil, fmt.Errorf("no certificates found in %s", caFile)
+		}
 	}
+
+	return config, nil
 }
 
-// Describe implements Prometheus.Collector.
-func (c collector) Describe(ch chan<- *prometheus.Desc) {
-	ch <- c.Errors
-	ch <- c.Score
-	ch <- c.DewPointC
-	ch <- c.DewPointF
-	ch <- c.TempC
-	ch <- c.TempF
-	ch <- c.Humid
-	ch <- c.AbsHumid
-	ch <- c.Co2
-	ch <- c.Co2Est
-	ch <- c.Co2EstBaseline
-	ch <- c.Voc
-	ch <- c.VocBaseline
-	ch <- c.VocH2Raw
-	ch <- c.VocEthanolRaw
-	ch <- c.Pm25
-	ch <- c.Pm10Est
+// sanitizeNames returns devices with each name lowercased and each
+// character other than a-z, 0-9 and _ replaced with _, along with a map
+// of sanitized name to original. It fails if two names sanitize to the
+// same one.
+func sanitizeNames(devices map[string]string) (map[string]string, map[string]string, error) {
+	sanitized := make(map[string]string)
+	displayNames := make(map[string]string)
+
+	for name, addr := range devices {
+		clean := strings.Map(func(r rune) rune {
+			if r >= 'a' && r <= 'z' || r >= '0' && r <= '9' || r == '_' {
+				return r
+			}
+			return '_'
+		}, strings.ToLower(name))
+
+		if other, ok := displayNames[clean]; ok {
+			return nil, nil, fmt.Errorf("%q and %q both sanitize to %q", other, name, clean)
+		}
+		sanitized[clean] = addr
+		displayNames[clean] = name
+	}
+
+	return sanitized, displayNames, nil
 }
 
-// Collect implements Prometheus.Collector.
-func (c collector) Collect(ch chan<- prometheus.Metric) {
-	var wg sync.WaitGroup
-	wg.Add(len(c.DeviceAddrs))
+// metricNameRE matches valid Prometheus metric names.
+var metricNameRE = regexp.MustCompile(`^[a-zA-Z_:][a-zA-Z0-9_:]*$`)
+
+// labelNameRE matches valid Prometheus label names.
+var labelNameRE = regexp.MustCompile(`^[a-zA-Z_][a-zA-Z0-9_]*$`)
 
-	for name, addr := range c.DeviceAddrs {
-		go func(name, addr string) {
-			c.collectOne(ch, name, addr)
-			wg.Done()
-		}(name, addr)
+// parseEndpoints parses a comma-separated list of /air-data windows. Each
+// must be named once.
+func parseEndpoints(list string) ([]string, error) {
+	var endpoints []string
+	for _, endpoint := range strings.Split(list, ",") {
+		if endpoint == "" {
+			return nil, fmt.Errorf("empty window in %q", list)
+		}
+		if slices.Contains(endpoints, endpoint) {
+			return nil, fmt.Errorf("window %q repeated in %q", endpoint, list)
+		}
+		endpoints = append(endpoints, endpoint)
+	}
+	return endpoints, nil
+}
+
+// parseStatusCodes parses a comma-separated list of HTTP status codes.
+func parseStatusCodes(list string) (map[int]bool, error) {
+	codes := make(map[int]bool)
+
+	for _, s := range strings.Split(list, ",") {
+		if s = strings.TrimSpace(s); s == "" {
+			continue
+		}
+
+		code, err := strconv.Atoi(s)
+		if err != nil || code < 100 || code > 599 {
+			return nil, fmt.Errorf("invalid status code %q", s)
+		}
+		codes[code] = true
 	}
 
-	wg.Wait()
+	return codes, nil
+}
+
+// headerFlag collects repeated "Name: value" flags into an http.Header.
+type headerFlag http.Header
+
+func (h headerFlag) String() string {
+	return fmt.Sprint(http.Header(h))
 }
 
-func (c collector) collectOne(ch chan<- prometheus.Metric, name, addr string) {
-	url := "http://" + addr + "/air-data/latest"
+func (h headerFlag) Set(value string) error {
+	name, val, ok := strings.Cut(value, ":")
+	if !ok {
+		return fmt.Errorf("expected \"Name: value\", got %q", value)
+	}
+	http.Header(h).Set(strings.TrimSpace(name), strings.TrimSpace(val))
+	return nil
+}
 
-	resp, err := c.Client.Get(url)
+// readFile adds a header for each non-blank line of filename.
+func (h headerFlag) readFile(filename string) error {
+	buf, err := os.ReadFile(filename)
 	if err != nil {
-		log.Printf("[%s] request failed: %v", addr, err)
-		return
+		return err
+	}
+
+	for _, line := range strings.Split(string(buf), "\n") {
+		if strings.TrimSpace(line) == "" {
+			continue
+		}
+		if err := h.Set(line); err != nil {
+			return err
+		}
 	}
-	defer resp.Body.Close()
 
-	labels := []string{name}
+	return nil
+}
 
-	if resp.StatusCode != 200 {
-		log.Printf("[%s:%s] non-200 response: %s", name, addr, resp.Status)
-		ch <- prometheus.MustNewConstMetric(c.Errors, prometheus.CounterValue, 1, labels...)
-		return
+// duplicateTargets resolves each device address and returns the names of
+// devices that have different addresses but resolve to the same ip:port,
+// keyed by that target. Aliases of a single address aren't duplicates, and
+// addresses without a port use the default port for scheme.
+func duplicateTargets(ctx context.Context, deviceAddrs map[string]string, scheme string) map[string][]string {
+	defaultPort := "80"
+	if scheme == "https" {
+		defaultPort = "443"
 	}
 
-	var airData struct {
-		// Timestamp is RFC3339 w/ millis, "2006-01-02T15:04:05.000Z"
-		Timestamp      string  `json:"timestamp"`
-		Score          int     `json:"score"`
-		DewPoint       float64 `json:"dew_point"`
-		Temp           float64 `json:"temp"`
-		Humid          float64 `json:"humid"`
-		AbsHumid       float64 `json:"abs_humid"`
-		Co2            int     `json:"co2"`
-		Co2Est         int     `json:"co2_est"`
-		Co2EstBaseline int     `json:"co2_est_baseline"`
-		Voc            int     `json:"voc"`
-		VocBaseline    int     `json:"voc_baseline"`
-		VocH2Raw       int     `json:"voc_h2_raw"`
-		VocEthanolRaw  int     `json:"voc_ethanol_raw"`
-		Pm25           int     `json:"pm25"`
-		Pm10Est        int     `json:"pm10_est"`
-	}
-
-	if err := json.NewDecoder(resp.Body).Decode(&airData); err != nil {
-		log.Printf("[%s:%s] could not parse AirData: %s", name, addr, err)
-		ch <- prometheus.MustNewConstMetric(c.Errors, prometheus.CounterValue, 1, name)
-		return
+	var (
+		addrs = make(map[string]int)
+		dups  = make(map[string][]string)
+	)
+	for addr, names := range awair.Aliases(deviceAddrs) {
+		host, port, err := net.SplitHostPort(addr)
+		if err != nil {
+			host, port = addr, defaultPort
+		}
+
+		ips, err := net.DefaultResolver.LookupHost(ctx, host)
+		if err != nil {
+			slog.Warn("Could not resolve device", "sensor", strings.Join(names, ","), "addr", addr, "err", err)
+			continue
+		}
+
+		for _, ip := range ips {
+			target := net.JoinHostPort(ip, port)
+			addrs[target]++
+			dups[target] = append(dups[target], names...)
+		}
 	}
 
-	ch <- prometheus.MustNewConstMetric(c.Score, prometheus.GaugeValue, float64(airData.Score), labels...)
-	ch <- prometheus.MustNewConstMetric(c.DewPointC, prometheus.GaugeValue, airData.DewPoint, labels...)
-	ch <- prometheus.MustNewConstMetric(c.DewPointF, prometheus.GaugeValue, celsiusToFahrenheit(airData.DewPoint), labels...)
-	ch <- prometheus.MustNewConstMetric(c.TempC, prometheus.GaugeValue, airData.Temp, labels...)
-	ch <- prometheus.MustNewConstMetric(c.TempF, prometheus.GaugeValue, celsiusToFahrenheit(airData.Temp), labels...)
-	ch <- prometheus.MustNewConstMetric(c.Humid, prometheus.GaugeValue, float64(airData.Humid), labels...)
-	ch <- prometheus.MustNewConstMetric(c.AbsHumid, prometheus.GaugeValue, float64(airData.AbsHumid), labels...)
-	ch <- prometheus.MustNewConstMetric(c.Co2, prometheus.GaugeValue, float64(airData.Co2), labels...)
-	ch <- prometheus.MustNewConstMetric(c.Co2Est, prometheus.GaugeValue, float64(airData.Co2Est), labels...)
-	ch <- prometheus.MustNewConstMetric(c.Co2EstBaseline, prometheus.GaugeValue, float64(airData.Co2EstBaseline), labels...)
-	ch <- prometheus.MustNewConstMetric(c.Voc, prometheus.GaugeValue, float64(airData.Voc), labels...)
-	ch <- prometheus.MustNewConstMetric(c.VocBaseline, prometheus.GaugeValue, float64(airData.VocBaseline), labels...)
-	ch <- prometheus.MustNewConstMetric(c.VocEthanolRaw, prometheus.GaugeValue, float64(airData.VocEthanolRaw), labels...)
-	ch <- prometheus.MustNewConstMetric(c.VocH2Raw, prometheus.GaugeValue, float64(airData.VocH2Raw), labels...)
-	ch <- prometheus.MustNewConstMetric(c.Pm25, prometheus.GaugeValue, float64(airData.Pm25), labels...)
-	ch <- prometheus.MustNewConstMetric(c.Pm10Est, prometheus.GaugeValue, float64(airData.Pm10Est), labels...)
-}
+	for target, names := range dups {
+		if addrs[target] < 2 {
+			delete(dups, target)
+			continue
+		}
+		sort.Strings(names)
+	}
 
-func celsiusToFahrenheit(tempC float64) float64 {
-	return tempC*9/5 + 32
+	return dups
 }
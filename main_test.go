@@ -0,0 +1,135 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/pteichman/awair_exporter/awair"
+)
+
+// sample gathers g and returns the value of the gauge or counter named
+// name with the label values in labels, if there is one.
+func sample(t *testing.T, g prometheus.Gatherer, name string, labels map[string]string) (float64, bool) {
+	t.Helper()
+
+	mfs, err := g.Gather()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, mf := range mfs {
+		if mf.GetName() != name {
+			continue
+		}
+	metrics:
+		for _, m := range mf.GetMetric() {
+			for _, label := range m.GetLabel() {
+				if value, ok := labels[label.GetName()]; ok && value != label.GetValue() {
+					continue metrics
+				}
+			}
+			if m.Counter != nil {
+				return m.GetCounter().GetValue(), true
+			}
+			return m.GetGauge().GetValue(), true
+		}
+	}
+
+	return 0, false
+}
+
+func TestRedirectPolicy(t *testing.T) {
+	device := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte(`{"timestamp": "2026-10-16T08:00:00.000Z", "co2": 600}`))
+	}))
+	defer device.Close()
+
+	// The proxy redirects to the device by the same host, 127.0.0.1, or a
+	// different one, localhost.
+	proxy := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		target := device.URL
+		if r.URL.Query().Get("host") == "other" {
+			target = strings.Replace(device.URL, "127.0.0.1", "localhost", 1)
+		}
+		http.Redirect(w, r, target+"/air-data/latest", http.StatusMovedPermanently)
+	}))
+	defer proxy.Close()
+
+	tests := []struct {
+		policy string
+		host   string
+
+		// redirected is true if the scrape should fail with reason
+		// "redirect"
+		redirected bool
+	}{
+		{"follow", "same", false},
+		{"follow", "other", false},
+		{"error", "same", true},
+		{"error", "other", true},
+		{"follow-same-host-only", "same", false},
+		{"follow-same-host-only", "other", true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.policy+"/"+tt.host, func(t *testing.T) {
+			checkRedirect, err := redirectPolicy(tt.policy)
+			if err != nil {
+				t.Fatal(err)
+			}
+			client := &http.Client{Timeout: time.Second, CheckRedirect: checkRedirect}
+
+			c := awair.New(client, map[string]string{"a": strings.TrimPrefix(proxy.URL, "http://")}, awair.Options{})
+			c.Paths = map[string]string{"latest": "/air-data/latest?host=" + tt.host}
+
+			reg := prometheus.NewRegistry()
+			reg.MustRegister(c)
+
+			co2, scraped := sample(t, reg, "awair_co2", map[string]string{"sensor": "a"})
+			redirects, _ := sample(t, reg, "awair_collection_errors_total", map[string]string{"sensor": "a", "reason": "redirect"})
+
+			if tt.redirected {
+				if scraped || redirects != 1 {
+					t.Errorf("got awair_co2 %v and %v redirect errors, want no readings and 1 error", co2, redirects)
+				}
+			} else if co2 != 600 || redirects != 0 {
+				t.Errorf("got awair_co2 %v and %v redirect errors, want 600 and none", co2, redirects)
+			}
+		})
+	}
+
+	if _, err := redirectPolicy("sometimes"); err == nil {
+		t.Error("redirectPolicy(\"sometimes\") succeeded, want an error")
+	}
+}
+
+func TestParseEndpoints(t *testing.T) {
+	tests := []struct {
+		list string
+		want string
+	}{
+		{"latest", "latest"},
+		{"latest,15-min-avg", "latest,15-min-avg"},
+		{"", ""},
+		{"latest,", ""},
+		{",latest", ""},
+		{"latest,latest", ""},
+	}
+
+	for _, tt := range tests {
+		endpoints, err := parseEndpoints(tt.list)
+		if tt.want == "" {
+			if err == nil {
+				t.Errorf("parseEndpoints(%q) = %q, want an error", tt.list, endpoints)
+			}
+			continue
+		}
+		if err != nil || strings.Join(endpoints, ",") != tt.want {
+			t.Errorf("parseEndpoints(%q) = %q, %v, want %s", tt.list, endpoints, err, tt.want)
+		}
+	}
+}
@@ -0,0 +1,127 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+	"math"
+	"net"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	dto "github.com/prometheus/client_model/go"
+)
+
+// statsdPacketSize is the largest UDP payload sent to statsd, small enough
+// to avoid fragmentation on an Ethernet MTU.
+const statsdPacketSize = 1432
+
+// statsdLoop gathers per-device gauges from g every interval and sends them
+// to conn as statsd gauges until ctx is canceled, counting failed sends in
+// failures.
+func statsdLoop(ctx context.Context, conn net.Conn, g prometheus.Gatherer, sensorLabel string, interval time.Duration, failures prometheus.Counter) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ticker.C:
+		case <-ctx.Done():
+			return
+		}
+
+		mfs, err := g.Gather()
+		if err != nil {
+			slog.Warn("Error gathering metrics for statsd", "err", err)
+		}
+
+		for _, packet := range statsdPackets(statsdLines(mfs, sensorLabel)) {
+			if _, err := conn.Write([]byte(packet)); err != nil {
+				slog.Warn("Error sending to statsd", "err", err)
+				failures.Inc()
+			}
+		}
+	}
+}
+
+// statsdLines returns a statsd gauge line, "awair.<sensor>.<metric>:<value>|g",
+// for each gauge or untyped sample in mfs that has sensorLabel. The values
+// of any other labels, such as the window, are appended to the name.
+func statsdLines(mfs []*dto.MetricFamily, sensorLabel string) []string {
+	var lines []string
+
+	for _, mf := range mfs {
+		if mf.GetType() != dto.MetricType_GAUGE && mf.GetType() != dto.MetricType_UNTYPED {
+			continue
+		}
+		metric := strings.TrimPrefix(mf.GetName(), "awair_")
+
+		for _, m := range mf.GetMetric() {
+			var sensor string
+			var extra []string
+			for _, label := range m.GetLabel() {
+				if label.GetName() == sensorLabel {
+					sensor = label.GetValue()
+				} else {
+					extra = append(extra, statsdName(label.GetValue()))
+				}
+			}
+			if sensor == "" {
+				continue
+			}
+
+			value := m.GetGauge().GetValue()
+			if mf.GetType() == dto.MetricType_UNTYPED {
+				value = m.GetUntyped().GetValue()
+			}
+			if math.IsNaN(value) || math.IsInf(value, 0) {
+				continue
+			}
+
+			name := strings.Join(append([]string{"awair", statsdName(sensor), metric}, extra...), ".")
+			lines = append(lines, fmt.Sprintf("%s:%g|g", name, value))
+		}
+	}
+
+	sort.Strings(lines)
+	return lines
+}
+
+// statsdName replaces the characters statsd treats specially in a name
+// component with _.
+func statsdName(s string) string {
+	return strings.Map(func(r rune) rune {
+		switch r {
+		case '.', ':', '|', '@', '#', ' ', '\n':
+			return '_'
+		}
+		return r
+	}, s)
+}
+
+// statsdPackets joins lines into newline-separated packets of at most
+// statsdPacketSize bytes, unless a single line is longer.
+func statsdPackets(lines []string) []string {
+	var (
+		packets []string
+		packet  string
+	)
+
+	for _, line := range lines {
+		if packet != "" && len(packet)+1+len(line) > statsdPacketSize {
+			packets = append(packets, packet)
+			packet = ""
+		}
+		if packet != "" {
+			packet += "\n"
+		}
+		packet += line
+	}
+	if packet != "" {
+		packets = append(packets, packet)
+	}
+
+	return packets
+}